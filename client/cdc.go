@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+// FastCDC: файл режется на куски по содержимому (gear‑хэш по скользящему
+// окну), а не по фиксированным смещениям. Вставка пары байт в середину
+// меняет один‑два куска, остальные совпадают с прежними — их не нужно
+// передавать заново. Параметры и таблица должны совпадать с серверными
+// (server/cdc.go), иначе куски не совпадут никогда.
+const (
+	cdcMin = 16 << 10
+	cdcAvg = 64 << 10
+	cdcMax = 256 << 10
+
+	// Нормализованное разбиение: до cdcAvg условие реза строже, после — мягче,
+	// так размеры кусков кучнее собираются вокруг cdcAvg
+	cdcMaskS uint64 = (1<<18 - 1) << 46
+	cdcMaskL uint64 = (1<<14 - 1) << 50
+)
+
+var gearTable = func() (t [256]uint64) {
+	for i := range t {
+		sum := sha256.Sum256([]byte{'s', 'y', 'n', 'c', 'e', 'r', 'c', 'h', byte(i)})
+		t[i] = binary.LittleEndian.Uint64(sum[:8])
+	}
+	return t
+}()
+
+// cdcCut возвращает длину первого куска data. Если data короче cdcMax,
+// считается, что это хвост файла.
+func cdcCut(data []byte) int {
+	n := len(data)
+	if n <= cdcMin {
+		return n
+	}
+	n = min(n, cdcMax)
+	normal := min(cdcAvg, n)
+	var h uint64
+	i := cdcMin
+	for ; i < normal; i++ {
+		h = h<<1 + gearTable[data[i]]
+		if h&cdcMaskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = h<<1 + gearTable[data[i]]
+		if h&cdcMaskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// cdcSplit читает r до конца и вызывает fn для каждого куска по порядку.
+// Срез chunk действителен только во время вызова.
+func cdcSplit(r io.Reader, fn func(chunk []byte) error) error {
+	buf := make([]byte, cdcMax)
+	n, eof := 0, false
+	for {
+		for !eof && n < len(buf) {
+			m, err := r.Read(buf[n:])
+			n += m
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if n == 0 {
+			return nil
+		}
+		cut := cdcCut(buf[:n])
+		if err := fn(buf[:cut]); err != nil {
+			return err
+		}
+		n = copy(buf, buf[cut:n])
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Отправка изменений по кускам: изменённые файлы режутся cdcSplit, сервер
+// говорит, каких кусков у него нет, и уходят только они — пачками в zip
+// (имя записи — SHA‑256 куска). Затем коммитятся рецепты файлов. Немного
+// поправленный большой PDF стоит пары кусков, а не всего файла.
+//
+// В зашифрованном vault это бесполезно: шифротекст меняется целиком при
+// любой правке. Там изменения по‑прежнему уходят архивом через postDelta.
+
+// errChunksUnsupported — сервер без /chunks, отправляем архивом
+var errChunksUnsupported = errors.New("server does not support chunked sync")
+
+type chunkRef struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// chunkedFile — рецепт файла для POST /chunks/commit
+type chunkedFile struct {
+	Path   string      `json:"path"`
+	Size   int64       `json:"size"`
+	Mode   os.FileMode `json:"mode"`
+	SHA256 string      `json:"sha256"`
+	Chunks []chunkRef  `json:"chunks"`
+}
+
+// chunkSource — где локально взять кусок
+type chunkSource struct {
+	path      string
+	off, size int64
+}
+
+// postChunks отправляет изменённые файлы кусками и применяет их вместе со
+// списком удалений, если vault всё ещё на ревизии rev. Возвращает, сколько
+// байт кусков реально ушло на сервер.
+func postChunks(serverURL, token, folderPath string, changed, deleted []string, rev int64) (int64, error) {
+	files := make([]chunkedFile, 0, len(changed))
+	sources := make(map[string]chunkSource)
+	for _, rel := range changed {
+		f, err := splitFile(folderPath, rel, sources)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", rel, err)
+		}
+		files = append(files, f)
+	}
+	hashes := make([]string, 0, len(sources))
+	for h := range sources {
+		hashes = append(hashes, h)
+	}
+	sort.Strings(hashes)
+
+	base := strings.TrimRight(serverURL, "/") + "/chunks"
+	var resp struct {
+		Missing []string `json:"missing"`
+	}
+	err := uploadJSON("POST", base+"/missing", token, noRevision, map[string]any{"chunks": hashes}, &resp)
+	if hasStatus(err, http.StatusNotFound, http.StatusMethodNotAllowed) {
+		return 0, errChunksUnsupported
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	sent, err := sendChunks(base, token, folderPath, resp.Missing, sources)
+	if err != nil {
+		return sent, err
+	}
+
+	if deleted == nil {
+		deleted = []string{}
+	}
+	for attempt := 0; ; attempt++ {
+		err = uploadJSON("POST", base+"/commit", token, rev, map[string]any{"files": files, "deleted": deleted}, nil)
+		missing := commitMissing(err)
+		if missing == nil || attempt == chunkCommitRetries {
+			return sent, err
+		}
+		// Кусок, который сервер считал своим, успел пропасть (его файл
+		// поменял параллельный коммит) — досылаем недостающее и повторяем
+		for _, h := range missing {
+			if _, ok := sources[h]; !ok {
+				return sent, fmt.Errorf("server asks for chunk %s that is not in the commit", h)
+			}
+		}
+		n, err := sendChunks(base, token, folderPath, missing, sources)
+		sent += n
+		if err != nil {
+			return sent, err
+		}
+	}
+}
+
+// chunkCommitRetries — сколько раз досылать куски, пропавшие к коммиту
+const chunkCommitRetries = 3
+
+// commitMissing — куски из ответа 409 на /chunks/commit, nil — ошибка другая
+func commitMissing(err error) []string {
+	var se *httpStatusError
+	if !errors.As(err, &se) || se.code != http.StatusConflict {
+		return nil
+	}
+	var body struct {
+		Missing []string `json:"missing"`
+	}
+	if json.Unmarshal([]byte(se.msg), &body) != nil || len(body.Missing) == 0 {
+		return nil
+	}
+	return body.Missing
+}
+
+// splitFile режет файл на куски и запоминает, где каждый кусок лежит
+func splitFile(folderPath, rel string, sources map[string]chunkSource) (chunkedFile, error) {
+	path := filepath.Join(folderPath, filepath.FromSlash(rel))
+	f, err := os.Open(path)
+	if err != nil {
+		return chunkedFile{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return chunkedFile{}, err
+	}
+
+	cf := chunkedFile{Path: rel, Mode: info.Mode().Perm(), Chunks: []chunkRef{}}
+	whole := sha256.New()
+	err = cdcSplit(f, func(chunk []byte) error {
+		sum := sha256.Sum256(chunk)
+		h := hex.EncodeToString(sum[:])
+		if _, ok := sources[h]; !ok {
+			sources[h] = chunkSource{path: path, off: cf.Size, size: int64(len(chunk))}
+		}
+		cf.Chunks = append(cf.Chunks, chunkRef{Hash: h, Size: int64(len(chunk))})
+		cf.Size += int64(len(chunk))
+		whole.Write(chunk)
+		return nil
+	})
+	cf.SHA256 = hex.EncodeToString(whole.Sum(nil))
+	return cf, err
+}
+
+// sendChunks отправляет недостающие куски пачками примерно по uploadChunkSize
+func sendChunks(base, token, folderPath string, missing []string, sources map[string]chunkSource) (int64, error) {
+	if len(missing) == 0 {
+		return 0, nil
+	}
+	if err := os.MkdirAll(filepath.Join(folderPath, internalDir), 0755); err != nil {
+		return 0, err
+	}
+	batchPath := filepath.Join(folderPath, internalDir, "chunks.zip")
+	defer os.Remove(batchPath)
+
+	var sent int64
+	for len(missing) > 0 {
+		n, size, err := writeChunkBatch(batchPath, missing, sources)
+		if err != nil {
+			return sent, err
+		}
+		err = withRetries(func() error {
+			return postChunkBatch(base, token, batchPath)
+		})
+		if err != nil {
+			return sent, err
+		}
+		sent += size
+		missing = missing[n:]
+	}
+	return sent, nil
+}
+
+// writeChunkBatch пишет в path архив из первых кусков missing, пока он не
+// дорастёт до uploadChunkSize. Возвращает число кусков и их объём.
+func writeChunkBatch(path string, missing []string, sources map[string]chunkSource) (n int, size int64, err error) {
+	out, err := os.Create(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	archive := zip.NewWriter(out)
+	for _, h := range missing {
+		if n > 0 && size >= uploadChunkSize {
+			break
+		}
+		src := sources[h]
+		data := make([]byte, src.size)
+		if err := readAt(src.path, src.off, data); err != nil {
+			return 0, 0, err
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != h {
+			return 0, 0, fmt.Errorf("%s changed while syncing", src.path)
+		}
+		w, err := archive.Create(h)
+		if err != nil {
+			return 0, 0, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return 0, 0, err
+		}
+		n++
+		size += src.size
+	}
+	return n, size, archive.Close()
+}
+
+func readAt(path string, off int64, data []byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.ReadAt(data, off)
+	return err
+}
+
+func postChunkBatch(base, token, batchPath string) error {
+	f, err := os.Open(batchPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	req, err := http.NewRequest("POST", base, f)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/zip")
+	setAuth(req, token)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
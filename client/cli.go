@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const cliUsage = `usage:
+  syncerch                      интерактивный режим
+  syncerch download [flags]     забрать изменения с сервера
+  syncerch upload [flags]       отправить локальные изменения на сервер
+  syncerch sync [flags]         двусторонняя синхронизация
+  syncerch watch [flags]        синхронизировать при изменениях, пока не остановят (SIGINT/SIGTERM)
+
+flags:
+  --config PATH   файл настроек (по умолчанию config.json)
+  --folder PATH   папка вместо folder_path из настроек
+  --server URL    сервер вместо server_url
+  --vault NAME    vault вместо vault
+  --token TOKEN   токен вместо token; можно передать в SYNCERCH_TOKEN
+  --json          итог в JSON (watch — по строке на каждую синхронизацию)
+
+exit codes:
+  0  успешно
+  1  ошибка
+  2  неверные аргументы или настройки
+  3  выполнено, но созданы конфликтные копии
+  4  vault на сервере изменился, ничего не перезаписано — повторите позже
+`
+
+// Коды выхода подкоманд — на них рассчитаны cron, systemd и скрипты
+const (
+	exitOK        = 0
+	exitError     = 1
+	exitUsage     = 2
+	exitConflicts = 3
+	exitStale     = 4
+)
+
+// cliResult — итог операции для --json. Поля общие для всех подкоманд:
+// uploaded/downloaded — сколько файлов ушло на сервер и пришло с него.
+type cliResult struct {
+	Command       string    `json:"command"`
+	Reason        string    `json:"reason,omitempty"` // только watch: start, local, remote, poll
+	Time          time.Time `json:"time"`
+	OK            bool      `json:"ok"`
+	ExitCode      int       `json:"exit_code"`
+	Error         string    `json:"error,omitempty"`
+	Uploaded      int       `json:"uploaded"`
+	Downloaded    int       `json:"downloaded"`
+	DeletedRemote int       `json:"deleted_remote"`
+	DeletedLocal  int       `json:"deleted_local"`
+	Full          bool      `json:"full,omitempty"` // сервер не умеет дельты, папка передана целиком
+	Conflicts     []string  `json:"conflicts"`
+	SentBytes     *int64    `json:"sent_bytes,omitempty"` // нет — изменения ушли архивом или не уходили
+
+	text string // итог без --json, как в статусе TUI
+}
+
+// runCommand выполняет одну операцию без TUI и возвращает код выхода.
+// Настройки берутся из config.json (или --config), флаги их перекрывают,
+// но обратно в файл не сохраняются.
+func runCommand(args []string, stdout, stderr io.Writer) int {
+	cmd := args[0]
+	switch cmd {
+	case "download", "upload", "sync", "watch":
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, cliUsage)
+		return exitOK
+	default:
+		fmt.Fprint(stderr, cliUsage)
+		return exitUsage
+	}
+
+	flags := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() { fmt.Fprint(stderr, cliUsage) }
+	config := flags.String("config", configFile, "файл настроек")
+	folder := flags.String("folder", "", "папка")
+	server := flags.String("server", "", "адрес сервера")
+	vault := flags.String("vault", "", "vault на сервере")
+	token := flags.String("token", "", "токен")
+	asJSON := flags.Bool("json", false, "итог в JSON")
+	if err := flags.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprint(stderr, cliUsage)
+		return exitUsage
+	}
+
+	// Явно указанный файл настроек должен существовать: молча взять дефолты
+	// вместо опечатки в пути — плохая идея для задания в cron
+	configFile = *config
+	if _, err := os.Stat(configFile); err != nil && isFlagSet(flags, "config") {
+		fmt.Fprintln(stderr, "error:", err)
+		return exitUsage
+	}
+	cfg := loadConfig()
+	if env := strings.TrimSpace(os.Getenv("SYNCERCH_TOKEN")); env != "" {
+		cfg.Token = env
+	}
+	if *folder != "" {
+		cfg.FolderPath = *folder
+	}
+	if *server != "" {
+		cfg.ServerURL = *server
+	}
+	if *token != "" {
+		cfg.Token = *token
+	}
+	if isFlagSet(flags, "vault") {
+		cfg.Vault = *vault
+	}
+	cfg.Token = strings.TrimSpace(cfg.Token)
+	cfg.FolderPath = strings.TrimSpace(cfg.FolderPath)
+	cfg.ServerURL = strings.TrimRight(strings.TrimSpace(cfg.ServerURL), "/")
+	switch {
+	case cfg.Token == "":
+		fmt.Fprintln(stderr, "error: no token: set it in the config, --token or SYNCERCH_TOKEN")
+		return exitUsage
+	case cfg.FolderPath == "":
+		fmt.Fprintln(stderr, "error: no folder: set it in the config or --folder")
+		return exitUsage
+	}
+	// Дальше папка — абсолютный путь: с ним сравниваются пути событий watch
+	abs, err := filepath.Abs(cfg.FolderPath)
+	if err != nil {
+		fmt.Fprintln(stderr, "error: folder:", err)
+		return exitUsage
+	}
+	cfg.FolderPath = abs
+	if err := setupHTTPClient(cfg); err != nil {
+		fmt.Fprintln(stderr, "error: TLS settings:", err)
+		return exitUsage
+	}
+
+	if cmd == "watch" {
+		return runWatch(cfg, *asJSON, stdout, stderr)
+	}
+	res, err := runOnce(cmd, cfg)
+	if *asJSON {
+		writeJSONResult(stdout, res)
+	} else if msg, ok := conflictStatus(err); ok {
+		fmt.Fprintln(stderr, "error:", msg)
+	} else if err != nil {
+		fmt.Fprintln(stderr, "error:", err)
+	} else {
+		fmt.Fprintln(stdout, res.text)
+	}
+	return res.ExitCode
+}
+
+// runOnce выполняет download, upload или sync
+func runOnce(cmd string, cfg Config) (cliResult, error) {
+	res := cliResult{Command: cmd, Time: time.Now().UTC()}
+	var err error
+	if err = openVaultCrypt(cfg); err == nil {
+		switch cmd {
+		case "download":
+			var st deltaStats
+			st, err = downloadChanges(cfg.vaultURL(), cfg.Token, cfg.FolderPath)
+			res.Downloaded, res.DeletedLocal, res.Full, res.Conflicts = st.Changed, st.Deleted, st.Full, st.Conflicts
+			res.text = "Папка успешно скачана" + st.summary()
+		case "upload":
+			var st deltaStats
+			st, err = uploadChanges(cfg.vaultURL(), cfg.Token, cfg.FolderPath)
+			res.Uploaded, res.DeletedRemote, res.Full, res.Conflicts = st.Changed, st.Deleted, st.Full, st.Conflicts
+			res.SentBytes = sentBytes(st.Sent, st.Changed)
+			res.text = "Папка успешно загружена" + st.summary()
+		case "sync":
+			var rep syncReport
+			rep, err = syncFolder(cfg.vaultURL(), cfg.Token, cfg.FolderPath)
+			res.fromReport(rep)
+			res.text = "Синхронизировано: " + rep.summary()
+			if len(rep.Conflicts) > 0 {
+				res.text = "Синхронизировано, есть конфликтные копии: " + rep.summary()
+			}
+		}
+	}
+	res.finish(err)
+	return res, err
+}
+
+// runWatch держит режим слежения до SIGINT/SIGTERM и печатает итог каждой
+// синхронизации. Ошибки отдельных синхронизаций слежение не прерывают.
+func runWatch(cfg Config, asJSON bool, stdout, stderr io.Writer) int {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	err := watchFolder(cfg, ctx.Done(), func(w watchResult) {
+		res := cliResult{Command: "watch", Reason: w.Reason, Time: w.Time.UTC()}
+		res.fromReport(w.Report)
+		res.finish(w.Err)
+		if asJSON {
+			writeJSONResult(stdout, res)
+			return
+		}
+		text, _ := watchStatus(w)
+		fmt.Fprintf(stdout, "%s [%s]\n", text, w.Reason)
+	})
+	if err != nil {
+		fmt.Fprintln(stderr, "error:", err)
+		return exitError
+	}
+	return exitOK
+}
+
+func (r *cliResult) fromReport(rep syncReport) {
+	r.Uploaded, r.Downloaded = rep.Pushed, rep.Pulled
+	r.DeletedRemote, r.DeletedLocal = rep.DeletedRemote, rep.DeletedLocal
+	r.Conflicts = rep.Conflicts
+	r.SentBytes = sentBytes(rep.Sent, rep.Pushed)
+}
+
+// finish выставляет ok, ошибку и код выхода
+func (r *cliResult) finish(err error) {
+	if r.Conflicts == nil {
+		r.Conflicts = []string{}
+	}
+	switch {
+	case isRevisionConflict(err):
+		r.ExitCode = exitStale
+	case err != nil:
+		r.ExitCode = exitError
+	case len(r.Conflicts) > 0:
+		r.ExitCode = exitConflicts
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	r.OK = err == nil
+}
+
+// sentBytes — сколько байт кусков ушло на сервер, если это известно
+func sentBytes(sent int64, files int) *int64 {
+	if sent < 0 || files == 0 {
+		return nil
+	}
+	return &sent
+}
+
+func writeJSONResult(w io.Writer, res cliResult) {
+	data, _ := json.Marshal(res)
+	fmt.Fprintln(w, string(data))
+}
+
+func isFlagSet(flags *flag.FlagSet, name string) bool {
+	set := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
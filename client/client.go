@@ -3,11 +3,11 @@ package main
 import (
 	"archive/zip"
 	"bufio"
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"mime/multipart"
+	"io/fs"
 	"net/http"
 	"net/url"
 	"os"
@@ -19,7 +19,9 @@ import (
 
 // Значение по умолчанию — можно менять в настройках из интерфейса
 const defaultServerURL = "http://syncerch.meysner.ru"
-const configFile = "config.json"
+
+// Файл настроек; подкоманды позволяют указать другой через --config
+var configFile = "config.json"
 
 const asciiLogo = `
                                  
@@ -57,13 +59,46 @@ const (
 	bgMagenta = "\x1b[45m"
 )
 
+// Кнопки главного меню, порядок совпадает с индексами в main
+var menuLabels = []string{"download", "upload", "sync", "watch", "settings"}
+
 type Config struct {
 	Token      string `json:"token"`
 	FolderPath string `json:"folder_path"`
 	ServerURL  string `json:"server_url"`
+	Vault      string `json:"vault,omitempty"` // пусто — vault "default" на сервере
+
+	// TLS (задаются только в config.json)
+	CAFile     string   `json:"ca_file,omitempty"`     // PEM с CA сервера вместо системных
+	PinSHA256  []string `json:"pin_sha256,omitempty"`  // SHA-256 публичного ключа сервера (base64 или hex)
+	ClientCert string   `json:"client_cert,omitempty"` // сертификат и ключ для mTLS
+	ClientKey  string   `json:"client_key,omitempty"`
+
+	// Сквозное шифрование (см. crypt.go), тоже только в config.json
+	Passphrase   string `json:"passphrase,omitempty"`
+	EncryptNames bool   `json:"encrypt_names,omitempty"` // учитывается при первом шифровании vault
+
+	// Режим слежения (см. watch.go), длительности вида "2s", "1m"
+	WatchDebounce string `json:"watch_debounce,omitempty"` // пауза после последней правки, по умолчанию 2s
+	WatchPoll     string `json:"watch_poll,omitempty"`     // опрос сервера, по умолчанию 30s
+}
+
+// vaultURL — базовый адрес выбранного vault: все запросы к папке идут от него
+func (c Config) vaultURL() string {
+	base := strings.TrimRight(c.ServerURL, "/")
+	v := strings.TrimSpace(c.Vault)
+	if v == "" || v == "default" {
+		return base
+	}
+	return base + "/vaults/" + url.PathEscape(v)
 }
 
 func main() {
+	// Подкоманды (syncerch sync и т.п.) работают без TUI — для cron, systemd и скриптов
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:], os.Stdout, os.Stderr))
+	}
+
 	cfg := loadConfig()
 	reader := bufio.NewReader(os.Stdin)
 
@@ -90,10 +125,15 @@ func main() {
 	}
 	defer keyboard.Close()
 
-	selected := 0 // 0=download, 1=upload, 2=settings
+	selected := 0 // индекс в menuLabels
 	status := ""
 	statusColor := "" // brightCyan/info, brightGreen/success, brightRed/error, brightYellow/progress
 
+	if err := setupHTTPClient(cfg); err != nil {
+		status = "Ошибка настроек TLS: " + err.Error()
+		statusColor = brightRed
+	}
+
 	for {
 		drawUI(selected, cfg, status, statusColor)
 
@@ -110,37 +150,72 @@ func main() {
 			return
 		case keyboard.KeyArrowLeft:
 			if selected == 0 {
-				selected = 2
+				selected = len(menuLabels) - 1
 			} else {
 				selected--
 			}
 		case keyboard.KeyArrowRight:
-			selected = (selected + 1) % 3
+			selected = (selected + 1) % len(menuLabels)
 		case keyboard.KeyEnter:
 			switch selected {
 			case 0: // download
 				status = "Скачивание..."
 				statusColor = brightYellow
 				drawUI(selected, cfg, status, statusColor)
-				if err := downloadFolder(cfg.ServerURL, cfg.Token, cfg.FolderPath); err != nil {
+				if err := openVaultCrypt(cfg); err != nil {
+					status = "Ошибка скачивания: " + err.Error()
+					statusColor = brightRed
+				} else if st, err := downloadChanges(cfg.vaultURL(), cfg.Token, cfg.FolderPath); err != nil {
 					status = "Ошибка скачивания: " + err.Error()
 					statusColor = brightRed
 				} else {
-					status = "Папка успешно скачана"
+					status = "Папка успешно скачана" + st.summary()
 					statusColor = brightGreen
 				}
 			case 1: // upload
 				status = "Загрузка..."
 				statusColor = brightYellow
 				drawUI(selected, cfg, status, statusColor)
-				if err := uploadFolder(cfg.ServerURL, cfg.Token, cfg.FolderPath); err != nil {
+				if err := openVaultCrypt(cfg); err != nil {
 					status = "Ошибка загрузки: " + err.Error()
 					statusColor = brightRed
+				} else if st, err := uploadChanges(cfg.vaultURL(), cfg.Token, cfg.FolderPath); err != nil {
+					if msg, ok := conflictStatus(err); ok {
+						status = "Загрузка отменена: " + msg
+						statusColor = brightYellow
+					} else {
+						status = "Ошибка загрузки: " + err.Error()
+						statusColor = brightRed
+					}
+				} else {
+					status = "Папка успешно загружена" + st.summary()
+					statusColor = brightGreen
+				}
+			case 2: // sync
+				status = "Синхронизация..."
+				statusColor = brightYellow
+				drawUI(selected, cfg, status, statusColor)
+				if err := openVaultCrypt(cfg); err != nil {
+					status = "Ошибка синхронизации: " + err.Error()
+					statusColor = brightRed
+				} else if rep, err := syncFolder(cfg.vaultURL(), cfg.Token, cfg.FolderPath); err != nil {
+					if msg, ok := conflictStatus(err); ok {
+						status = "Синхронизация не завершена: " + msg
+						statusColor = brightYellow
+					} else {
+						status = "Ошибка синхронизации: " + err.Error()
+						statusColor = brightRed
+					}
+				} else if len(rep.Conflicts) > 0 {
+					status = "Синхронизировано, есть конфликтные копии: " + rep.summary()
+					statusColor = brightYellow
 				} else {
-					status = "Папка успешно загружена"
+					status = "Синхронизировано: " + rep.summary()
 					statusColor = brightGreen
 				}
-			case 2: // settings
+			case 3: // watch
+				status, statusColor = watchScreen(selected, cfg)
+			case 4: // settings
 				if err := settingsScreen(&cfg, reader); err != nil {
 					status = "Ошибка настроек: " + err.Error()
 					statusColor = brightRed
@@ -165,12 +240,18 @@ func drawUI(selected int, cfg Config, status, sColor string) {
 
 	// Инфо
 	fmt.Printf("%sСервер:%s %s\n", brightBlue, reset, cfg.ServerURL)
-	fmt.Printf("%sПапка:%s  %s\n\n", brightBlue, reset, cfg.FolderPath)
+	if cfg.Vault != "" {
+		fmt.Printf("%sVault:%s  %s\n", brightBlue, reset, cfg.Vault)
+	}
+	fmt.Printf("%sПапка:%s  %s\n", brightBlue, reset, cfg.FolderPath)
+	if cfg.Passphrase != "" {
+		fmt.Printf("%sШифрование:%s включено\n", brightBlue, reset)
+	}
+	fmt.Println()
 	// fmt.Printf("%sТокен:%s  %s\n", brightBlue, reset, maskToken(cfg.Token))
 
-	// Кнопки меню: download, upload, settings
-	labels := []string{"download", "upload", "settings"}
-	for i, label := range labels {
+	// Кнопки меню
+	for i, label := range menuLabels {
 		if i > 0 {
 			fmt.Print("   ")
 		}
@@ -195,6 +276,13 @@ func drawUI(selected int, cfg Config, status, sColor string) {
 	}
 }
 
+func vaultLabel(v string) string {
+	if v == "" {
+		return "default"
+	}
+	return v
+}
+
 func buttonSelected(s string) string {
 	return bgBlue + brightWhite + bold + s + reset
 }
@@ -236,7 +324,8 @@ func loadConfig() Config {
 }
 
 func saveConfig(cfg Config) {
-	file, err := os.Create(configFile)
+	// В конфиге токен и passphrase — только для владельца
+	file, err := os.OpenFile(configFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		fmt.Println("Не удалось сохранить конфигурацию:", err)
 		return
@@ -247,85 +336,115 @@ func saveConfig(cfg Config) {
 
 // =================== NETWORK / IO ===================
 
-func uploadFolder(serverURL, token, folderPath string) error {
-	tmpZip := "temp_upload.zip"
+// uploadFolder заменяет vault на сервере содержимым папки, если vault всё ещё
+// на ревизии rev (noRevision — сервер ревизий не знает)
+func uploadFolder(serverURL, token, folderPath string, rev int64) error {
+	// Архив кладём в служебную папку: zipFolder её пропускает, а докачка
+	// после обрыва пересоберёт его там же байт в байт
+	if err := os.MkdirAll(filepath.Join(folderPath, internalDir), 0755); err != nil {
+		return err
+	}
+	tmpZip := filepath.Join(folderPath, internalDir, "upload.zip")
 	if err := zipFolder(folderPath, tmpZip); err != nil {
 		return err
 	}
 	defer os.Remove(tmpZip)
 
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-
-	part, err := writer.CreateFormFile("folder", filepath.Base(tmpZip))
-	if err != nil {
-		return err
+	err := sendArchive(serverURL, token, folderPath, tmpZip, "replace", nil, rev)
+	if errors.Is(err, errChunkedUnsupported) {
+		err = postUploadForm(serverURL, token, tmpZip, rev)
 	}
-	file, err := os.Open(tmpZip)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-	if _, err := io.Copy(part, file); err != nil {
-		return err
+	if vaultCrypt != nil {
+		vaultCrypt.fresh = false // keyFileName уехал вместе с архивом
 	}
-	_ = writer.Close()
+	return nil
+}
+
+// postUploadForm отправляет архив одним запросом на /upload (для серверов без /uploads)
+func postUploadForm(serverURL, token, zipPath string, rev int64) error {
+	body, contentType := multipartBody(nil, "folder", zipPath)
+	defer body.Close()
 
 	req, err := http.NewRequest("POST", strings.TrimRight(serverURL, "/")+"/upload", body)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	req.Header.Set("Authorization", token)
+	req.Header.Set("Content-Type", contentType)
+	setAuth(req, token)
+	setIfMatch(req, rev)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		data, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("server error: %s", string(data))
-	}
-	return nil
+	return checkResponse(resp)
 }
 
 func downloadFolder(serverURL, token, folderPath string) error {
-	req, err := http.NewRequest("GET", strings.TrimRight(serverURL, "/")+"/download", nil)
-	if err != nil {
+	folderPath = filepath.Clean(folderPath)
+	if err := os.MkdirAll(filepath.Dir(folderPath), 0755); err != nil {
 		return err
 	}
-	req.Header.Set("Authorization", token)
+	tmpZip := folderPath + downloadPartSuffix
+	if err := fetchArchive(serverURL, token, tmpZip); err != nil {
+		return err // недокачанный архив остаётся для следующей попытки
+	}
+	defer removePartial(tmpZip)
 
-	resp, err := http.DefaultClient.Do(req)
+	// Распаковываем рядом с папкой, а не в неё: оборванный или битый архив
+	// (unzip сверяет CRC каждого файла) не должен стоить локальных заметок
+	staged, err := os.MkdirTemp(filepath.Dir(folderPath), filepath.Base(folderPath)+".syncerch-tmp-*")
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	defer os.RemoveAll(staged)
+	_ = os.Chmod(staged, 0755) // MkdirTemp создаёт 0700
+	if err := unzip(tmpZip, staged); err != nil {
+		return err
+	}
+	return replaceFolder(folderPath, staged)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		data, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("server error: %s", string(data))
+// replaceFolder подменяет folderPath каталогом staged. Прежняя папка до конца
+// операции лежит рядом как <папка>.syncerch-backup и возвращается на место при ошибке.
+func replaceFolder(folderPath, staged string) error {
+	backup := folderPath + ".syncerch-backup"
+
+	_, folderErr := os.Stat(folderPath)
+	if _, err := os.Stat(backup); err == nil {
+		if errors.Is(folderErr, fs.ErrNotExist) {
+			// Прошлый запуск оборвался посреди подмены — бэкап и есть папка
+			if err := os.Rename(backup, folderPath); err != nil {
+				return err
+			}
+			folderErr = nil
+		} else if err := os.RemoveAll(backup); err != nil {
+			return err
+		}
 	}
 
-	tmpZip := "temp_download.zip"
-	out, err := os.Create(tmpZip)
-	if err != nil {
-		return err
+	hadFolder := folderErr == nil
+	if hadFolder {
+		if err := os.Rename(folderPath, backup); err != nil {
+			return err
+		}
 	}
-	if _, err := io.Copy(out, resp.Body); err != nil {
-		out.Close()
+	if err := os.Rename(staged, folderPath); err != nil {
+		if hadFolder {
+			if rerr := os.Rename(backup, folderPath); rerr != nil {
+				return fmt.Errorf("%v (previous folder kept at %s: %v)", err, backup, rerr)
+			}
+		}
 		return err
 	}
-	out.Close()
-	defer os.Remove(tmpZip)
-
-	_ = os.RemoveAll(folderPath)
-	if err := os.MkdirAll(folderPath, 0755); err != nil {
-		return err
+	if hadFolder {
+		return os.RemoveAll(backup)
 	}
-	return unzip(tmpZip, folderPath)
+	return nil
 }
 
 func zipFolder(src, dest string) error {
@@ -340,7 +459,7 @@ func zipFolder(src, dest string) error {
 
 	src = filepath.Clean(src)
 
-	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -352,40 +471,37 @@ func zipFolder(src, dest string) error {
 		if rel == "." {
 			return nil
 		}
+		if info.IsDir() && rel == internalDir {
+			return filepath.SkipDir
+		}
 
 		// В ZIP всегда пишем с прямыми слэшами — это кроссплатформенно
 		name := filepath.ToSlash(rel)
-
-		header, err := zip.FileInfoHeader(info)
-		if err != nil {
-			return err
+		if isKeyFile(name) {
+			return nil
 		}
-		header.Name = name
 
 		if info.IsDir() {
+			header, err := zip.FileInfoHeader(info)
+			if err != nil {
+				return err
+			}
 			// Явно помечаем директорию
-			if !strings.HasSuffix(header.Name, "/") {
-				header.Name += "/"
+			header.Name, err = remotePath(name + "/")
+			if err != nil {
+				return err
 			}
 			_, err = archive.CreateHeader(header)
 			return err
 		}
 
-		header.Method = zip.Deflate
-		writer, err := archive.CreateHeader(header)
-		if err != nil {
-			return err
-		}
-
-		f, err := os.Open(path)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-
-		_, err = io.Copy(writer, f)
-		return err
+		return addZipFile(archive, path, name, info)
 	})
+	if err != nil || vaultCrypt == nil {
+		return err
+	}
+	// Полная загрузка заменяет vault целиком, keyFileName должен быть в ней
+	return addKeyFile(archive)
 }
 
 func unzip(src, dest string) error {
@@ -408,6 +524,14 @@ func unzip(src, dest string) error {
 		name := f.Name
 		name = strings.ReplaceAll(name, "\\", "/")
 		name = strings.TrimLeft(name, "/")
+		if vaultCrypt != nil {
+			if isKeyFile(name) {
+				continue
+			}
+			if name, err = vaultCrypt.decryptPath(name); err != nil {
+				return err
+			}
+		}
 		name = filepath.Clean(filepath.FromSlash(name))
 
 		fpath := filepath.Join(dest, name)
@@ -438,10 +562,15 @@ func unzip(src, dest string) error {
 			outFile.Close()
 			return err
 		}
-		if _, err = io.Copy(outFile, rc); err != nil {
+		if vaultCrypt != nil {
+			err = vaultCrypt.decrypt(outFile, rc, filepath.ToSlash(name))
+		} else {
+			_, err = io.Copy(outFile, rc)
+		}
+		if err != nil {
 			rc.Close()
 			outFile.Close()
-			return err
+			return fmt.Errorf("%s: %w", name, err)
 		}
 		rc.Close()
 		outFile.Close()
@@ -466,12 +595,12 @@ func settingsScreen(cfg *Config, reader *bufio.Reader) error {
 			return nil
 		case keyboard.KeyArrowUp:
 			if selected == 0 {
-				selected = 3
+				selected = 4
 			} else {
 				selected--
 			}
 		case keyboard.KeyArrowDown:
-			selected = (selected + 1) % 4
+			selected = (selected + 1) % 5
 		case keyboard.KeyEnter:
 			switch selected {
 			case 0: // folder path
@@ -509,7 +638,20 @@ func settingsScreen(cfg *Config, reader *bufio.Reader) error {
 				} else {
 					status = dim + "Отменено" + reset
 				}
-			case 3: // back
+			case 3: // vault
+				if val, ok, err := promptLine("\nИмя vault на сервере (default — основной) (пусто — отмена): ", reader); err != nil {
+					status = "Ошибка ввода: " + err.Error()
+				} else if ok {
+					if val == "default" {
+						val = ""
+					}
+					cfg.Vault = val
+					saveConfig(*cfg)
+					status = green + "Vault обновлен" + reset
+				} else {
+					status = dim + "Отменено" + reset
+				}
+			case 4: // back
 				return nil
 			}
 		default:
@@ -530,6 +672,7 @@ func drawSettingsUI(selected int, cfg Config, status string) {
 		fmt.Sprintf("Изменить путь к папке   [%s]", cfg.FolderPath),
 		fmt.Sprintf("Изменить токен          [%s]", maskToken(cfg.Token)),
 		fmt.Sprintf("Изменить адрес сервера  [%s]", cfg.ServerURL),
+		fmt.Sprintf("Изменить vault          [%s]", vaultLabel(cfg.Vault)),
 		"Назад",
 	}
 	for i, it := range items {
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// conflictName строит имя копии в духе Dropbox/Syncthing:
+// "dir/note.md" -> "dir/note (conflict from laptop 2025-08-29 14-51-43).md"
+func conflictName(rel, host string, t time.Time) string {
+	dir, base := path.Split(rel)
+	ext := path.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	if stem == "" { // файлы вида ".gitignore"
+		stem, ext = base, ""
+	}
+	return fmt.Sprintf("%s%s (conflict from %s %s)%s", dir, stem, host, t.Format("2006-01-02 15-04-05"), ext)
+}
+
+// hostName — имя машины, пригодное для имени файла на любой ОС
+func hostName() string {
+	h, err := os.Hostname()
+	if err != nil || strings.TrimSpace(h) == "" {
+		return "unknown"
+	}
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, h)
+}
+
+// freeConflictName подбирает имя конфликтной копии, которого ещё нет в папке
+func freeConflictName(folderPath, rel string) (string, error) {
+	name := conflictName(rel, hostName(), time.Now())
+	candidate := name
+	for i := 2; ; i++ {
+		_, err := os.Lstat(filepath.Join(folderPath, filepath.FromSlash(candidate)))
+		if errors.Is(err, fs.ErrNotExist) {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		ext := path.Ext(name)
+		candidate = fmt.Sprintf("%s %d%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+}
+
+// moveToConflictCopy переименовывает локальный файл в конфликтную копию
+// и возвращает её относительный путь
+func moveToConflictCopy(folderPath, rel string) (string, error) {
+	name, err := freeConflictName(folderPath, rel)
+	if err != nil {
+		return "", err
+	}
+	from := filepath.Join(folderPath, filepath.FromSlash(rel))
+	to := filepath.Join(folderPath, filepath.FromSlash(name))
+	if err := os.Rename(from, to); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// fetchConflictCopy скачивает серверную версию файла рядом с локальной под конфликтным именем
+func fetchConflictCopy(serverURL, token, folderPath string, f FileEntry) (FileEntry, error) {
+	name, err := freeConflictName(folderPath, f.Path)
+	if err != nil {
+		return FileEntry{}, err
+	}
+	if err := fetchFileTo(serverURL, token, folderPath, f, name); err != nil {
+		return FileEntry{}, err
+	}
+	f.Path = name
+	return f, nil
+}
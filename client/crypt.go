@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Сквозное шифрование: сервер видит только шифротекст (и, если включено,
+// зашифрованные имена). Ключ выводится из passphrase в config.json; соль и
+// проверочное значение лежат в корне vault в keyFileName — это единственный
+// файл, который сервер видит открытым, и по нему другие устройства узнают,
+// что vault зашифрован, и проверяют свою passphrase.
+//
+// Шифрование детерминированное (как SIV): одинаковое содержимое даёт одинаковый
+// шифротекст, поэтому SHA-256 из серверного манифеста по‑прежнему годится для
+// сравнения версий. Локально для сравнения считается SHA-256 того же шифротекста.
+//
+// Формат файла: "SYC1" | siv[16] | сегменты. siv = HMAC(sivKey, путь | открытый
+// текст)[:16], ключ файла = HKDF(contentKey, siv). Каждые 64 КиБ открытого текста —
+// отдельный сегмент AES-256-GCM с nonce = номер сегмента | признак последнего.
+// Обрезка, перестановка и подмена сегментов ловятся GCM. Путь (открытый) входит в
+// siv, поэтому шифротекст другого файла того же vault, подложенный на место этого,
+// не пройдёт сверку siv. Откат файла к его же прежней версии так не поймать.
+
+const (
+	keyFileName      = ".syncerch-crypt.json"
+	cryptMagic       = "SYC1"
+	cryptSIVSize     = 16
+	cryptHeaderSize  = len(cryptMagic) + cryptSIVSize
+	cryptSegmentSize = 64 << 10
+	cryptTagSize     = 16
+	pbkdf2Iterations = 600_000
+	maxNameLen       = 255 // предел длины имени файла на большинстве ФС
+)
+
+// vaultKeyFile — содержимое keyFileName
+type vaultKeyFile struct {
+	Version      int    `json:"version"`
+	KDF          string `json:"kdf"`
+	Iterations   int    `json:"iterations"`
+	Salt         []byte `json:"salt"`
+	EncryptNames bool   `json:"encrypt_names"`
+	Check        []byte `json:"check"` // HMAC(checkKey, ...) — проверка passphrase
+}
+
+// vaultCipher — ключи одного зашифрованного vault
+type vaultCipher struct {
+	contentKey, sivKey, nameEncKey, nameMacKey, checkKey []byte
+
+	keyFile vaultKeyFile
+	fresh   bool // keyFileName ещё нет на сервере, его надо отправить со следующей записью
+}
+
+// vaultCrypt — шифр текущего vault, nil — vault не зашифрован. Выставляется openVaultCrypt
+// перед каждой операцией.
+var vaultCrypt *vaultCipher
+
+var (
+	errWrongPassphrase   = errors.New("wrong passphrase for this vault")
+	errVaultEncrypted    = errors.New("vault on the server is encrypted: set passphrase in config.json")
+	errVaultNotEncrypted = errors.New("vault on the server is not encrypted yet: run upload to encrypt it")
+)
+
+// derivedKeys кэширует ключи по (passphrase, соль): PBKDF2 намеренно медленный
+var derivedKeys = make(map[string]*vaultCipher)
+
+func newVaultCipher(passphrase string, kf vaultKeyFile) (*vaultCipher, error) {
+	cacheKey := passphrase + "\x00" + string(kf.Salt) + fmt.Sprint(kf.Iterations)
+	if vc, ok := derivedKeys[cacheKey]; ok {
+		c := *vc
+		c.keyFile = kf
+		return &c, nil
+	}
+	if kf.Version != 1 || kf.KDF != "pbkdf2-sha256" || kf.Iterations < 1 || len(kf.Salt) < 16 {
+		return nil, fmt.Errorf("unsupported %s (version %d, kdf %q)", keyFileName, kf.Version, kf.KDF)
+	}
+	master, err := pbkdf2.Key(sha256.New, passphrase, kf.Salt, kf.Iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	vc := &vaultCipher{keyFile: kf}
+	for _, k := range []struct {
+		dst  *[]byte
+		info string
+	}{
+		{&vc.contentKey, "syncerch content"},
+		{&vc.sivKey, "syncerch siv"},
+		{&vc.nameEncKey, "syncerch name enc"},
+		{&vc.nameMacKey, "syncerch name mac"},
+		{&vc.checkKey, "syncerch check"},
+	} {
+		if *k.dst, err = hkdf.Key(sha256.New, master, nil, k.info, 32); err != nil {
+			return nil, err
+		}
+	}
+	derivedKeys[cacheKey] = vc
+	c := *vc
+	return &c, nil
+}
+
+func (vc *vaultCipher) check() []byte {
+	m := hmac.New(sha256.New, vc.checkKey)
+	m.Write([]byte("syncerch passphrase check"))
+	return m.Sum(nil)
+}
+
+// id — короткий отпечаток ключа (не секрет): по нему кэш хэшей понимает, что ключ сменился
+func (vc *vaultCipher) id() string {
+	return base64.RawURLEncoding.EncodeToString(vc.check()[:9])
+}
+
+// openVaultCrypt читает keyFileName с сервера и выставляет vaultCrypt.
+// Без passphrase работает только с незашифрованным vault, с ней — только с
+// зашифрованным ею же (или с ещё пустым: тогда vault станет зашифрованным).
+func openVaultCrypt(cfg Config) error {
+	vaultCrypt = nil
+	kf, found, err := fetchKeyFile(cfg.vaultURL(), cfg.Token)
+	if err != nil {
+		return err
+	}
+	if cfg.Passphrase == "" {
+		if found {
+			return errVaultEncrypted
+		}
+		return nil
+	}
+
+	fresh := !found
+	if fresh {
+		kf = vaultKeyFile{Version: 1, KDF: "pbkdf2-sha256", Iterations: pbkdf2Iterations, Salt: make([]byte, 32), EncryptNames: cfg.EncryptNames}
+		if _, err := rand.Read(kf.Salt); err != nil {
+			return err
+		}
+	}
+	vc, err := newVaultCipher(cfg.Passphrase, kf)
+	if err != nil {
+		return err
+	}
+	if fresh {
+		vc.keyFile.Check = vc.check()
+	} else if !hmac.Equal(vc.check(), kf.Check) {
+		return errWrongPassphrase
+	}
+	vc.fresh = fresh
+	vaultCrypt = vc
+	return nil
+}
+
+// fetchKeyFile скачивает keyFileName; found=false, если его нет
+func fetchKeyFile(serverURL, token string) (vaultKeyFile, bool, error) {
+	var kf vaultKeyFile
+	req, err := http.NewRequest("GET", filesURL(serverURL, keyFileName), nil)
+	if err != nil {
+		return kf, false, err
+	}
+	setAuth(req, token)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return kf, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return kf, false, nil
+	}
+	if err := checkResponse(resp); err != nil {
+		return kf, false, err
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&kf); err != nil {
+		return kf, false, fmt.Errorf("bad %s: %w", keyFileName, err)
+	}
+	return kf, true, nil
+}
+
+func (vc *vaultCipher) keyFileJSON() ([]byte, error) {
+	return json.MarshalIndent(vc.keyFile, "", "  ")
+}
+
+// ---------- содержимое ----------
+
+func plainSize(n int64) int64 {
+	n -= int64(cryptHeaderSize)
+	segments := max(1, (n+cryptSegmentSize+cryptTagSize-1)/(cryptSegmentSize+cryptTagSize))
+	return max(0, n-segments*cryptTagSize)
+}
+
+func segmentNonce(i uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, i)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func (vc *vaultCipher) fileAEAD(siv []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, vc.contentKey, siv, "syncerch file", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sivHash — HMAC для siv файла rel (путь относительно корня, через "/").
+// Длина пути идёт впереди, чтобы путь и содержимое нельзя было сдвинуть.
+func (vc *vaultCipher) sivHash(rel string) hash.Hash {
+	mac := hmac.New(sha256.New, vc.sivKey)
+	binary.Write(mac, binary.BigEndian, uint64(len(rel)))
+	mac.Write([]byte(rel))
+	return mac
+}
+
+// encrypt пишет в w шифротекст содержимого r файла rel. Читает r дважды:
+// сначала ради siv.
+func (vc *vaultCipher) encrypt(w io.Writer, r io.ReadSeeker, rel string) error {
+	mac := vc.sivHash(rel)
+	if _, err := io.Copy(mac, r); err != nil {
+		return err
+	}
+	siv := mac.Sum(nil)[:cryptSIVSize]
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	aead, err := vc.fileAEAD(siv)
+	if err != nil {
+		return err
+	}
+	header := append([]byte(cryptMagic), siv...)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	br := bufio.NewReaderSize(r, cryptSegmentSize)
+	buf := make([]byte, cryptSegmentSize)
+	out := make([]byte, 0, cryptSegmentSize+cryptTagSize)
+	for i := uint64(0); ; i++ {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		last := err != nil
+		if !last {
+			// Ровно полный сегмент: последний ли он, узнаём, заглянув вперёд
+			if _, perr := br.Peek(1); perr == io.EOF {
+				last = true
+			}
+		}
+		out = aead.Seal(out[:0], segmentNonce(i, last), buf[:n], header)
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// decrypt пишет в w открытый текст шифротекста r файла rel. Если данные
+// подменены, лежат не под своим путём или ключ не тот, возвращает ошибку —
+// уже записанное в w надо выбросить.
+func (vc *vaultCipher) decrypt(w io.Writer, r io.Reader, rel string) error {
+	header := make([]byte, cryptHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return errors.New("not an encrypted file")
+	}
+	if string(header[:len(cryptMagic)]) != cryptMagic {
+		return errors.New("not an encrypted file")
+	}
+	siv := header[len(cryptMagic):]
+	aead, err := vc.fileAEAD(siv)
+	if err != nil {
+		return err
+	}
+
+	mac := vc.sivHash(rel)
+	br := bufio.NewReaderSize(r, cryptSegmentSize+cryptTagSize)
+	buf := make([]byte, cryptSegmentSize+cryptTagSize)
+	out := make([]byte, 0, cryptSegmentSize)
+	for i := uint64(0); ; i++ {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		last := err != nil
+		if !last {
+			if _, perr := br.Peek(1); perr == io.EOF {
+				last = true
+			}
+		}
+		out, err = aead.Open(out[:0], segmentNonce(i, last), buf[:n], header)
+		if err != nil {
+			return errors.New("decryption failed: file is corrupted or was encrypted with another key")
+		}
+		mac.Write(out)
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+		if last {
+			break
+		}
+	}
+	if !hmac.Equal(mac.Sum(nil)[:cryptSIVSize], siv) {
+		return errors.New("decryption failed: content does not match its checksum or path")
+	}
+	return nil
+}
+
+// cipherSHA256 — SHA-256 шифротекста, который получится из r файла rel (hex)
+func (vc *vaultCipher) cipherSHA256(r io.ReadSeeker, rel string) (string, error) {
+	h := sha256.New()
+	if err := vc.encrypt(h, r, rel); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// ---------- имена ----------
+
+var nameEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// encryptPath шифрует каждый сегмент пути отдельно (структура каталогов сохраняется).
+// Без encrypt_names возвращает путь как есть.
+func (vc *vaultCipher) encryptPath(rel string) (string, error) {
+	if !vc.keyFile.EncryptNames {
+		return rel, nil
+	}
+	trailing := strings.HasSuffix(rel, "/")
+	parts := strings.Split(strings.TrimSuffix(rel, "/"), "/")
+	for i, p := range parts {
+		mac := hmac.New(sha256.New, vc.nameMacKey)
+		mac.Write([]byte(p))
+		iv := mac.Sum(nil)[:aes.BlockSize]
+		block, err := aes.NewCipher(vc.nameEncKey)
+		if err != nil {
+			return "", err
+		}
+		ct := make([]byte, len(p))
+		cipher.NewCTR(block, iv).XORKeyStream(ct, []byte(p))
+		parts[i] = nameEncoding.EncodeToString(append(iv, ct...))
+		if len(parts[i]) > maxNameLen {
+			return "", fmt.Errorf("name %q is too long to encrypt", p)
+		}
+	}
+	out := strings.Join(parts, "/")
+	if trailing {
+		out += "/"
+	}
+	return out, nil
+}
+
+// decryptPath — обратное к encryptPath
+func (vc *vaultCipher) decryptPath(rel string) (string, error) {
+	if !vc.keyFile.EncryptNames {
+		return rel, nil
+	}
+	trailing := strings.HasSuffix(rel, "/")
+	parts := strings.Split(strings.TrimSuffix(rel, "/"), "/")
+	for i, p := range parts {
+		raw, err := nameEncoding.DecodeString(p)
+		if err != nil || len(raw) < aes.BlockSize {
+			return "", fmt.Errorf("cannot decrypt name %q", path.Clean(rel))
+		}
+		iv, ct := raw[:aes.BlockSize], raw[aes.BlockSize:]
+		block, err := aes.NewCipher(vc.nameEncKey)
+		if err != nil {
+			return "", err
+		}
+		pt := make([]byte, len(ct))
+		cipher.NewCTR(block, iv).XORKeyStream(pt, ct)
+		mac := hmac.New(sha256.New, vc.nameMacKey)
+		mac.Write(pt)
+		if !hmac.Equal(mac.Sum(nil)[:aes.BlockSize], iv) {
+			return "", fmt.Errorf("cannot decrypt name %q", path.Clean(rel))
+		}
+		parts[i] = string(pt)
+	}
+	out := strings.Join(parts, "/")
+	if trailing {
+		out += "/"
+	}
+	return out, nil
+}
+
+// ---------- манифест ----------
+
+// decryptManifest переводит серверный манифест в локальные имена и размеры.
+// SHA-256 остаётся хэшем шифротекста — с ним и сравниваются локальные файлы.
+func (vc *vaultCipher) decryptManifest(m Manifest) (Manifest, error) {
+	files := make([]FileEntry, 0, len(m.Files))
+	for _, f := range m.Files {
+		if f.Path == keyFileName {
+			continue
+		}
+		if vc.fresh {
+			return Manifest{}, errVaultNotEncrypted
+		}
+		p, err := vc.decryptPath(f.Path)
+		if err != nil {
+			return Manifest{}, err
+		}
+		f.Path = p
+		f.Size = plainSize(f.Size)
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return Manifest{Files: files}, nil
+}
+
+// encryptPaths — серверные пути для списка локальных
+func (vc *vaultCipher) encryptPaths(rels []string) ([]string, error) {
+	out := make([]string, len(rels))
+	for i, r := range rels {
+		p, err := vc.encryptPath(r)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = p
+	}
+	return out, nil
+}
+
+// remotePath — путь файла на сервере с учётом шифрования имён
+func remotePath(rel string) (string, error) {
+	if vaultCrypt == nil {
+		return rel, nil
+	}
+	return vaultCrypt.encryptPath(rel)
+}
+
+// isKeyFile — служебный файл шифрования в корне папки; не синхронизируется как обычный
+func isKeyFile(rel string) bool {
+	return rel == keyFileName
+}
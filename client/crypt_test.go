@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"testing"
+)
+
+// testCipher — шифр с дешёвым KDF; ключи те же, что дала бы passphrase
+func testCipher(t *testing.T, encryptNames bool) *vaultCipher {
+	t.Helper()
+	kf := vaultKeyFile{Version: 1, KDF: "pbkdf2-sha256", Iterations: 1, Salt: bytes.Repeat([]byte{7}, 16), EncryptNames: encryptNames}
+	vc, err := newVaultCipher("test passphrase", kf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vc
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func encryptBytes(t *testing.T, vc *vaultCipher, plain []byte, rel string) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	if err := vc.encrypt(&out, bytes.NewReader(plain), rel); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func decryptBytes(vc *vaultCipher, ct []byte, rel string) ([]byte, error) {
+	var out bytes.Buffer
+	err := vc.decrypt(&out, bytes.NewReader(ct), rel)
+	return out.Bytes(), err
+}
+
+// segment возвращает i-й сегмент шифротекста
+func segment(ct []byte, i int) []byte {
+	start := cryptHeaderSize + i*(cryptSegmentSize+cryptTagSize)
+	return ct[start:min(len(ct), start+cryptSegmentSize+cryptTagSize)]
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	vc := testCipher(t, false)
+	for _, n := range []int{0, 1, 100, cryptSegmentSize - 1, cryptSegmentSize, cryptSegmentSize + 1, 2 * cryptSegmentSize, 3*cryptSegmentSize + 17} {
+		plain := randomBytes(t, n)
+		ct := encryptBytes(t, vc, plain, "notes/a.md")
+		if got := plainSize(int64(len(ct))); got != int64(n) {
+			t.Errorf("size %d: plainSize = %d", n, got)
+		}
+		got, err := decryptBytes(vc, ct, "notes/a.md")
+		if err != nil {
+			t.Fatalf("size %d: %v", n, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("size %d: round trip mismatch", n)
+		}
+		// Детерминированность: на ней держится сравнение по SHA-256 манифеста
+		if again := encryptBytes(t, vc, plain, "notes/a.md"); !bytes.Equal(again, ct) {
+			t.Fatalf("size %d: encryption is not deterministic", n)
+		}
+	}
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	ct := encryptBytes(t, testCipher(t, false), []byte("secret"), "a.md")
+	kf := vaultKeyFile{Version: 1, KDF: "pbkdf2-sha256", Iterations: 1, Salt: bytes.Repeat([]byte{8}, 16)}
+	other, err := newVaultCipher("test passphrase", kf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decryptBytes(other, ct, "a.md"); err == nil {
+		t.Fatal("decrypted with another key")
+	}
+}
+
+func TestDecryptTruncated(t *testing.T) {
+	vc := testCipher(t, false)
+	ct := encryptBytes(t, vc, randomBytes(t, 2*cryptSegmentSize+100), "a.md")
+	for _, n := range []int{0, cryptHeaderSize - 1, cryptHeaderSize, cryptHeaderSize + 10, len(ct) - 1, len(ct) - cryptTagSize} {
+		if _, err := decryptBytes(vc, ct[:n], "a.md"); err == nil {
+			t.Errorf("truncated to %d bytes: no error", n)
+		}
+	}
+}
+
+func TestDecryptReorderedSegments(t *testing.T) {
+	vc := testCipher(t, false)
+	ct := encryptBytes(t, vc, randomBytes(t, 2*cryptSegmentSize+100), "a.md")
+	var swapped []byte
+	swapped = append(swapped, ct[:cryptHeaderSize]...)
+	swapped = append(swapped, segment(ct, 1)...)
+	swapped = append(swapped, segment(ct, 0)...)
+	swapped = append(swapped, segment(ct, 2)...)
+	if _, err := decryptBytes(vc, swapped, "a.md"); err == nil {
+		t.Fatal("reordered segments decrypted")
+	}
+}
+
+func TestDecryptLastSegmentFlag(t *testing.T) {
+	vc := testCipher(t, false)
+	// Ровно два полных сегмента: отрезанный по границе сегмента файл без
+	// признака последнего сегмента не должен сойти за целый
+	ct := encryptBytes(t, vc, randomBytes(t, 2*cryptSegmentSize), "a.md")
+	if n := cryptHeaderSize + 2*(cryptSegmentSize+cryptTagSize); len(ct) != n {
+		t.Fatalf("ciphertext is %d bytes, want %d", len(ct), n)
+	}
+	cut := ct[:cryptHeaderSize+cryptSegmentSize+cryptTagSize]
+	if _, err := decryptBytes(vc, cut, "a.md"); err == nil {
+		t.Fatal("file cut at a segment boundary decrypted")
+	}
+	// И наоборот: лишний сегмент после последнего
+	extended := append(append([]byte(nil), ct...), segment(ct, 1)...)
+	if _, err := decryptBytes(vc, extended, "a.md"); err == nil {
+		t.Fatal("file with a segment after the last one decrypted")
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	vc := testCipher(t, false)
+	ct := encryptBytes(t, vc, randomBytes(t, 1000), "a.md")
+	for _, i := range []int{0, len(cryptMagic), cryptHeaderSize, len(ct) - 1} {
+		bad := append([]byte(nil), ct...)
+		bad[i] ^= 1
+		if _, err := decryptBytes(vc, bad, "a.md"); err == nil {
+			t.Errorf("flipped byte %d: no error", i)
+		}
+	}
+}
+
+func TestDecryptSubstitutedFile(t *testing.T) {
+	vc := testCipher(t, false)
+	// Сервер кладёт на место a.md шифротекст b.md из того же vault
+	other := encryptBytes(t, vc, []byte("contents of b"), "b.md")
+	if _, err := decryptBytes(vc, other, "a.md"); err == nil {
+		t.Fatal("another file's ciphertext decrypted under a different path")
+	}
+	// Одинаковое содержимое под разными путями шифруется по‑разному
+	if bytes.Equal(encryptBytes(t, vc, []byte("x"), "a.md"), encryptBytes(t, vc, []byte("x"), "b.md")) {
+		t.Fatal("path is not bound into the ciphertext")
+	}
+}
+
+func TestEncryptPathRoundTrip(t *testing.T) {
+	vc := testCipher(t, true)
+	for _, rel := range []string{"a.md", "notes/daily/2024-01-01.md", "dir/", "Заметки/файл с пробелами.md"} {
+		enc, err := vc.encryptPath(rel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Count(enc, "/") != strings.Count(rel, "/") {
+			t.Errorf("%q: directory structure not kept: %q", rel, enc)
+		}
+		for _, part := range strings.Split(strings.TrimSuffix(rel, "/"), "/") {
+			if strings.Contains(enc, part) {
+				t.Errorf("%q: plaintext %q visible in %q", rel, part, enc)
+			}
+		}
+		if again, _ := vc.encryptPath(rel); again != enc {
+			t.Errorf("%q: name encryption is not deterministic", rel)
+		}
+		dec, err := vc.decryptPath(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dec != rel {
+			t.Errorf("decryptPath(encryptPath(%q)) = %q", rel, dec)
+		}
+	}
+}
+
+func TestDecryptPathTampered(t *testing.T) {
+	vc := testCipher(t, true)
+	enc, err := vc.encryptPath("notes/a.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, name, _ := strings.Cut(enc, "/")
+	b := []byte(name)
+	if b[len(b)-1] == 'a' {
+		b[len(b)-1] = 'b'
+	} else {
+		b[len(b)-1] = 'a'
+	}
+	for _, bad := range []string{dir + "/" + string(b), "plain/a.md", dir + "/x"} {
+		if _, err := vc.decryptPath(bad); err == nil {
+			t.Errorf("decryptPath(%q): no error", bad)
+		}
+	}
+	if _, err := vc.encryptPath(strings.Repeat("x", 200)); err == nil {
+		t.Error("too long name encrypted")
+	}
+}
+
+func TestPathsWithoutNameEncryption(t *testing.T) {
+	vc := testCipher(t, false)
+	for _, rel := range []string{"a.md", "notes/b.md"} {
+		if enc, err := vc.encryptPath(rel); err != nil || enc != rel {
+			t.Errorf("encryptPath(%q) = %q, %v", rel, enc, err)
+		}
+	}
+}
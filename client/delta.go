@@ -0,0 +1,517 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// deltaStats — сколько файлов реально ушло/пришло при дельта‑синхронизации
+type deltaStats struct {
+	Changed   int
+	Deleted   int
+	Full      bool     // сервер не умеет дельты, передали всю папку
+	Conflicts []string // созданные конфликтные копии и восстановленные файлы
+	Sent      int64    // байт кусков ушло на сервер, -1 — изменения ушли архивом
+}
+
+// summary — хвост для статусной строки TUI
+func (s deltaStats) summary() string {
+	if s.Full {
+		return " (целиком)"
+	}
+	if s.Changed == 0 && s.Deleted == 0 && len(s.Conflicts) == 0 {
+		return " (изменений нет)"
+	}
+	out := fmt.Sprintf(" (изменено: %d, удалено: %d", s.Changed, s.Deleted)
+	if s.Sent >= 0 && s.Changed > 0 {
+		out += ", передано: " + formatSize(s.Sent)
+	}
+	if len(s.Conflicts) > 0 {
+		out += fmt.Sprintf(", конфликты: %s", strings.Join(s.Conflicts, ", "))
+	}
+	return out + ")"
+}
+
+// uploadChanges отправляет на сервер только добавленные/изменённые файлы и список удалённых.
+// Если после прошлой синхронизации файл поменяли и локально, и на сервере, серверная
+// версия не затирается: сохраняется локально конфликтной копией и уезжает на сервер
+// рядом. Файл, изменённый только на сервере, остаётся для download.
+// Если сервер дельты не поддерживает — загружает папку целиком.
+func uploadChanges(serverURL, token, folderPath string) (deltaStats, error) {
+	remote, err := fetchManifest(serverURL, token)
+	if errors.Is(err, errDeltaUnsupported) {
+		return deltaStats{Full: true}, uploadFolder(serverURL, token, folderPath, noRevision)
+	}
+	if errors.Is(err, errVaultNotEncrypted) {
+		// Первое шифрование непустого vault: открытые файлы заменяем целиком
+		return deltaStats{Full: true}, encryptVault(serverURL, token, folderPath, remote.Revision)
+	}
+	if err != nil {
+		return deltaStats{}, err
+	}
+	local, err := localManifest(folderPath)
+	if err != nil {
+		return deltaStats{}, err
+	}
+	state, err := loadState(folderPath)
+	if err != nil {
+		return deltaStats{}, err
+	}
+
+	var st deltaStats
+	baseIdx, remoteIdx := state.Synced.byPath(), remote.byPath()
+	uploaded := local.Files
+	var changed []string
+	for _, f := range local.Files {
+		r, ok := remoteIdx[f.Path]
+		if ok && r.SHA256 == f.SHA256 {
+			continue
+		}
+		if ok && changedSince(baseIdx, r) {
+			if !changedSince(baseIdx, f) {
+				// Изменился только сервер: это работа для download, а не upload.
+				// В состоянии остаётся прежняя версия — она и есть общая база.
+				continue
+			}
+			cp, err := fetchConflictCopy(serverURL, token, folderPath, r)
+			if err != nil {
+				return st, fmt.Errorf("%s: %w", f.Path, err)
+			}
+			changed = append(changed, cp.Path)
+			uploaded = append(uploaded, cp)
+			st.Conflicts = append(st.Conflicts, cp.Path)
+		}
+		changed = append(changed, f.Path)
+	}
+	localIdx := local.byPath()
+	var deleted []string
+	for _, f := range remote.Files {
+		if _, ok := localIdx[f.Path]; ok {
+			continue
+		}
+		if changedSince(baseIdx, f) {
+			// Локально удалён, но на сервере менялся — возвращаем, а не удаляем
+			if err := fetchFile(serverURL, token, folderPath, f); err != nil {
+				return st, fmt.Errorf("%s: %w", f.Path, err)
+			}
+			uploaded = append(uploaded, f)
+			st.Conflicts = append(st.Conflicts, f.Path)
+			continue
+		}
+		deleted = append(deleted, f.Path)
+	}
+
+	if len(changed) > 0 || len(deleted) > 0 {
+		if st.Sent, err = sendChanges(serverURL, token, folderPath, changed, deleted, remote.Revision); err != nil {
+			return st, err
+		}
+	}
+	// Теперь сервер совпадает с локальной папкой, кроме файлов, изменённых только на сервере
+	sort.Slice(uploaded, func(i, j int) bool { return uploaded[i].Path < uploaded[j].Path })
+	if err := saveState(folderPath, syncState{Synced: Manifest{Files: uploaded}}); err != nil {
+		return st, err
+	}
+	st.Changed, st.Deleted = len(changed), len(deleted)
+	return st, nil
+}
+
+// encryptVault загружает папку целиком (уже зашифрованной) и делает её базой
+func encryptVault(serverURL, token, folderPath string, rev int64) error {
+	local, err := localManifest(folderPath)
+	if err != nil {
+		return err
+	}
+	if err := uploadFolder(serverURL, token, folderPath, rev); err != nil {
+		return err
+	}
+	return saveState(folderPath, syncState{Synced: local})
+}
+
+// changedSince — отличается ли версия f от той, что была при прошлой синхронизации.
+// Если прошлой синхронизации не было, считаем, что отличается: так надёжнее.
+func changedSince(base map[string]FileEntry, f FileEntry) bool {
+	b, ok := base[f.Path]
+	return !ok || b.SHA256 != f.SHA256
+}
+
+// downloadChanges докачивает только отсутствующие/изменённые файлы и удаляет те,
+// что исчезли с сервера со времени прошлой синхронизации. Файлы, которых на сервере
+// никогда не было, не трогает; локальные правки, сделанные после прошлой синхронизации,
+// переименовывает в конфликтные копии. Если сервер дельты не поддерживает — скачивает целиком.
+func downloadChanges(serverURL, token, folderPath string) (deltaStats, error) {
+	remote, err := fetchManifest(serverURL, token)
+	if errors.Is(err, errDeltaUnsupported) {
+		return deltaStats{Full: true}, downloadFolder(serverURL, token, folderPath)
+	}
+	if err != nil {
+		return deltaStats{}, err
+	}
+	if err := os.MkdirAll(folderPath, 0755); err != nil {
+		return deltaStats{}, err
+	}
+	local, err := localManifest(folderPath)
+	if err != nil {
+		return deltaStats{}, err
+	}
+	state, err := loadState(folderPath)
+	if err != nil {
+		return deltaStats{}, err
+	}
+
+	var st deltaStats
+	localIdx, syncedIdx := local.byPath(), state.Synced.byPath()
+	for _, f := range remote.Files {
+		l, ok := localIdx[f.Path]
+		if ok && l.SHA256 == f.SHA256 {
+			continue
+		}
+		if ok && changedSince(syncedIdx, l) {
+			cp, err := moveToConflictCopy(folderPath, f.Path)
+			if err != nil {
+				return st, fmt.Errorf("%s: %w", f.Path, err)
+			}
+			st.Conflicts = append(st.Conflicts, cp)
+		}
+		if err := fetchFile(serverURL, token, folderPath, f); err != nil {
+			return st, fmt.Errorf("%s: %w", f.Path, err)
+		}
+		st.Changed++
+	}
+
+	remoteIdx := remote.byPath()
+	for _, l := range local.Files {
+		if _, ok := remoteIdx[l.Path]; ok {
+			continue
+		}
+		// Удаляем только то, что было на сервере и с тех пор не менялось локально
+		if s, ok := syncedIdx[l.Path]; !ok || s.SHA256 != l.SHA256 {
+			continue
+		}
+		if err := removeLocal(folderPath, l.Path); err != nil {
+			return st, err
+		}
+		st.Deleted++
+	}
+
+	if err := saveState(folderPath, syncState{Synced: remote}); err != nil {
+		return st, err
+	}
+	return st, nil
+}
+
+// fetchFile скачивает один файл во временный файл, сверяет SHA-256 с манифестом
+// и только потом подменяет локальную копию
+func fetchFile(serverURL, token, folderPath string, f FileEntry) error {
+	return fetchFileTo(serverURL, token, folderPath, f, f.Path)
+}
+
+// fetchFileTo — как fetchFile, но кладёт файл по другому относительному пути
+func fetchFileTo(serverURL, token, folderPath string, f FileEntry, dstRel string) error {
+	remote, err := remotePath(f.Path)
+	if err != nil {
+		return err
+	}
+	tmpDir := filepath.Join(folderPath, internalDir)
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return err
+	}
+	// Файлов за раз может быть больше, чем пропускает лимит запросов сервера:
+	// на 429 ждём по Retry-After и повторяем, как с кусками загрузки
+	var tmp string
+	err = withRetries(func() error {
+		var ferr error
+		tmp, ferr = fetchToTemp(filesURL(serverURL, remote), token, tmpDir, f.SHA256)
+		return ferr
+	})
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	ready := tmp
+	if vaultCrypt != nil {
+		// Сверили шифротекст, теперь расшифровываем во второй временный файл.
+		// Путь — серверный, а не dstRel: конфликтная копия лежит под другим именем.
+		if ready, err = decryptToTemp(tmp, tmpDir, f.Path); err != nil {
+			return err
+		}
+		defer os.Remove(ready)
+	}
+
+	dst := filepath.Join(folderPath, filepath.FromSlash(dstRel))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if f.Mode != 0 {
+		_ = os.Chmod(ready, f.Mode.Perm())
+	}
+	if !f.ModTime.IsZero() {
+		_ = os.Chtimes(ready, f.ModTime, f.ModTime)
+	}
+	return os.Rename(ready, dst)
+}
+
+// fetchToTemp скачивает url во временный файл в dir и сверяет SHA-256
+func fetchToTemp(url, token, dir, sum string) (string, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	setAuth(req, token)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", statusError(resp)
+	}
+
+	tmp, err := os.CreateTemp(dir, "fetch-*")
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), resp.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		if got := hex.EncodeToString(h.Sum(nil)); got != sum {
+			err = fmt.Errorf("checksum mismatch: got %s, want %s", got, sum)
+		}
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// decryptToTemp расшифровывает файл src (в vault он лежит по пути rel) во
+// временный файл в dir и возвращает его путь
+func decryptToTemp(src, dir, rel string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(dir, "plain-*")
+	if err != nil {
+		return "", err
+	}
+	err = vaultCrypt.decrypt(out, in, rel)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// removeLocal удаляет файл и опустевшие каталоги над ним (но не саму папку)
+func removeLocal(folderPath, rel string) error {
+	root := filepath.Clean(folderPath)
+	path := filepath.Join(root, filepath.FromSlash(rel))
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for dir := filepath.Dir(path); dir != root && strings.HasPrefix(dir, root+string(os.PathSeparator)); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// filesURL — адрес /files/<path> с экранированием каждого сегмента пути
+func filesURL(serverURL, rel string) string {
+	parts := strings.Split(rel, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.TrimRight(serverURL, "/") + "/files/" + strings.Join(parts, "/")
+}
+
+// sendChanges отправляет изменения кусками (только недостающими), а если
+// vault зашифрован или сервер кусков не умеет — архивом через postDelta.
+// rev — ревизия манифеста, по которому вычислены изменения: если vault с тех
+// пор изменился, сервер их не примет (revisionConflictError).
+// Возвращает объём отправленных кусков или -1, если ушёл архив.
+func sendChanges(serverURL, token, folderPath string, changed, deleted []string, rev int64) (int64, error) {
+	if vaultCrypt == nil {
+		sent, err := postChunks(serverURL, token, folderPath, changed, deleted, rev)
+		if !errors.Is(err, errChunksUnsupported) {
+			return sent, err
+		}
+	}
+	return -1, postDelta(serverURL, token, folderPath, changed, deleted, rev)
+}
+
+// formatSize — размер для статусной строки
+func formatSize(n int64) string {
+	switch {
+	case n < 1<<10:
+		return fmt.Sprintf("%d Б", n)
+	case n < 1<<20:
+		return fmt.Sprintf("%.1f КБ", float64(n)/(1<<10))
+	case n < 1<<30:
+		return fmt.Sprintf("%.1f МБ", float64(n)/(1<<20))
+	default:
+		return fmt.Sprintf("%.1f ГБ", float64(n)/(1<<30))
+	}
+}
+
+// postDelta упаковывает перечисленные файлы в zip и отправляет их вместе со списком удалений.
+// Большой архив уходит докачиваемой загрузкой, маленький — одним запросом.
+func postDelta(serverURL, token, folderPath string, changed, deleted []string, rev int64) error {
+	if deleted == nil {
+		deleted = []string{}
+	}
+	if vaultCrypt != nil {
+		var err error
+		if deleted, err = vaultCrypt.encryptPaths(deleted); err != nil {
+			return err
+		}
+	}
+
+	var tmpZip string
+	if len(changed) > 0 || vaultCrypt != nil && vaultCrypt.fresh {
+		if err := os.MkdirAll(filepath.Join(folderPath, internalDir), 0755); err != nil {
+			return err
+		}
+		tmpZip = filepath.Join(folderPath, internalDir, "delta.zip")
+		out, err := os.Create(tmpZip)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmpZip)
+		err = zipFiles(folderPath, changed, out)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		if info, err := os.Stat(tmpZip); err == nil && info.Size() > uploadChunkSize {
+			err := sendArchive(serverURL, token, folderPath, tmpZip, "delta", deleted, rev)
+			if !errors.Is(err, errChunkedUnsupported) {
+				if err == nil && vaultCrypt != nil {
+					vaultCrypt.fresh = false
+				}
+				return err
+			}
+		}
+	}
+
+	list, err := json.Marshal(deleted)
+	if err != nil {
+		return err
+	}
+	body, contentType := multipartBody(map[string]string{"deleted": string(list)}, "files", tmpZip)
+	defer body.Close()
+
+	req, err := http.NewRequest("POST", strings.TrimRight(serverURL, "/")+"/delta", body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	setAuth(req, token)
+	setIfMatch(req, rev)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	if vaultCrypt != nil {
+		vaultCrypt.fresh = false
+	}
+	return nil
+}
+
+// zipFiles пишет в w zip‑архив с файлами rels (пути относительно src, с прямыми слэшами)
+func zipFiles(src string, rels []string, w io.Writer) error {
+	archive := zip.NewWriter(w)
+	for _, rel := range rels {
+		path := filepath.Join(src, filepath.FromSlash(rel))
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if err := addZipFile(archive, path, rel, info); err != nil {
+			return err
+		}
+	}
+	if vaultCrypt != nil && vaultCrypt.fresh {
+		// Первая запись в зашифрованный vault — вместе с ней уходит keyFileName
+		if err := addKeyFile(archive); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// addZipFile добавляет в архив один обычный файл под именем name
+func addZipFile(archive *zip.Writer, path, name string, info os.FileInfo) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+	if vaultCrypt != nil {
+		if header.Name, err = vaultCrypt.encryptPath(name); err != nil {
+			return err
+		}
+		header.Method = zip.Store // шифротекст не сжимается
+	}
+	writer, err := archive.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if vaultCrypt != nil {
+		return vaultCrypt.encrypt(writer, f, name)
+	}
+	_, err = io.Copy(writer, f)
+	return err
+}
+
+// addKeyFile кладёт в архив открытый keyFileName зашифрованного vault
+func addKeyFile(archive *zip.Writer) error {
+	data, err := vaultCrypt.keyFileJSON()
+	if err != nil {
+		return err
+	}
+	w, err := archive.Create(keyFileName)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"1", time.Second},
+		{"120", 2 * time.Minute},
+		{"0", 0},
+		{"-5", 0},
+		{"soon", 0},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if tt.header != "" {
+			resp.Header.Set("Retry-After", tt.header)
+		}
+		if got := retryAfter(resp); got != tt.want {
+			t.Errorf("Retry-After %q: got %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+// limitedServer отдаёт body, но первые limited запросов отвечает 429
+func limitedServer(t *testing.T, body string, limited int32, retry string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= limited {
+			w.Header().Set("Retry-After", retry)
+			http.Error(w, `{"error":"rate limit exceeded"}`, http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestFetchFileRetriesRateLimit(t *testing.T) {
+	const body = "hello"
+	sum := sha256.Sum256([]byte(body))
+	f := FileEntry{Path: "notes/a.md", SHA256: hex.EncodeToString(sum[:])}
+
+	srv, calls := limitedServer(t, body, 2, "1")
+	dir := t.TempDir()
+	if err := fetchFileTo(srv.URL, "tok", dir, f, f.Path); err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("%d requests, want 3", n)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "notes", "a.md"))
+	if err != nil || string(data) != body {
+		t.Fatalf("file = %q, %v", data, err)
+	}
+
+	// Бан на десять минут: ждать его смысла нет, ошибка сразу
+	srv, calls = limitedServer(t, body, 100, "600")
+	if err := fetchFileTo(srv.URL, "tok", t.TempDir(), f, f.Path); !hasStatus(err, http.StatusTooManyRequests) {
+		t.Fatalf("err = %v, want 429", err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("%d requests while banned, want 1", n)
+	}
+}
+
+func TestUploadSkipsRemoteOnlyChange(t *testing.T) {
+	sha := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.md"), []byte("base"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	base := Manifest{Files: []FileEntry{{Path: "a.md", Size: 4, SHA256: sha("base")}}}
+	if err := saveState(dir, syncState{Synced: base}); err != nil {
+		t.Fatal(err)
+	}
+
+	// На сервере a.md поменяли, локально — нет: upload не должен ничего отправлять
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || r.URL.Path != "/manifest" {
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+			http.Error(w, "unexpected", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"files":[{"path":"a.md","size":6,"sha256":"` + sha("remote") + `"}]}`))
+	}))
+	defer srv.Close()
+
+	st, err := uploadChanges(srv.URL, "tok", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Changed != 0 || len(st.Conflicts) != 0 {
+		t.Errorf("changed %d, conflicts %v; want nothing", st.Changed, st.Conflicts)
+	}
+	state, err := loadState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := state.Synced.byPath()["a.md"].SHA256; got != sha("base") {
+		t.Errorf("synced a.md = %s, want the base version", got)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Полный архив качается в <папка>.syncerch-download.zip рядом с папкой
+// (саму папку downloadFolder целиком подменяет), ETag архива — в файле
+// с суффиксом .etag. Если загрузка оборвалась, следующая попытка — тут же
+// или при следующем запуске — просит у сервера только хвост (Range) при
+// условии, что архив не изменился (If-Range). Изменился — сервер отдаст
+// новый целиком.
+const downloadPartSuffix = ".syncerch-download.zip"
+
+// fetchArchive докачивает архив vault в partPath, повторяя попытки при обрывах
+func fetchArchive(serverURL, token, partPath string) error {
+	return withRetries(func() error {
+		return fetchArchiveOnce(serverURL, token, partPath)
+	})
+}
+
+func fetchArchiveOnce(serverURL, token, partPath string) error {
+	etagPath := partPath + ".etag"
+	var offset int64
+	etag, _ := os.ReadFile(etagPath)
+	if fi, err := os.Stat(partPath); err == nil && len(etag) > 0 {
+		offset = fi.Size()
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimRight(serverURL, "/")+"/download", nil)
+	if err != nil {
+		return err
+	}
+	setAuth(req, token)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", string(etag))
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if start, _, ok := contentRange(resp.Header.Get("Content-Range")); !ok || start != offset {
+			return fmt.Errorf("unexpected Content-Range %q", resp.Header.Get("Content-Range"))
+		}
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		// Архив поменялся или сервер не умеет Range — начинаем сначала
+		flags |= os.O_TRUNC
+		if err := saveETag(etagPath, resp.Header.Get("ETag")); err != nil {
+			return err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Хвоста нет: файл уже скачан целиком, если длина совпадает
+		if _, total, ok := contentRange(resp.Header.Get("Content-Range")); ok && total == offset {
+			return nil
+		}
+		_ = os.Remove(partPath)
+		return errors.New("partial download does not match the archive, starting over")
+	default:
+		return statusError(resp)
+	}
+
+	out, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(out, resp.Body)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// contentRange разбирает "bytes 100-199/1000" и "bytes */1000"
+func contentRange(h string) (start, total int64, ok bool) {
+	spec, ok := strings.CutPrefix(h, "bytes ")
+	if !ok {
+		return 0, 0, false
+	}
+	rng, size, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, false
+	}
+	total, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if rng == "*" {
+		return -1, total, true
+	}
+	first, _, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, false
+	}
+	start, err = strconv.ParseInt(first, 10, 64)
+	return start, total, err == nil
+}
+
+// saveETag запоминает ETag архива; без него докачка невозможна
+func saveETag(path, etag string) error {
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	return os.WriteFile(path, []byte(etag), 0644)
+}
+
+// removePartial удаляет недокачанный архив и его ETag
+func removePartial(partPath string) {
+	_ = os.Remove(partPath)
+	_ = os.Remove(partPath + ".etag")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Поток GET /events: сервер сообщает о каждой записи в vault (новая ревизия
+// и изменённые пути). Режим слежения по нему забирает чужие правки сразу,
+// а не при следующем опросе. Старый сервер без /events — остаётся опрос.
+const (
+	eventsBackoffMin = time.Second
+	eventsBackoffMax = time.Minute
+	maxEventLine     = 1 << 20 // событие с тысячей путей не влезет в буфер Scanner по умолчанию
+)
+
+// revisionEvent — событие потока /events
+type revisionEvent struct {
+	Revision  int64    `json:"revision"`
+	Action    string   `json:"action"`
+	Paths     []string `json:"paths"`
+	Truncated bool     `json:"truncated"`
+}
+
+// watchEvents держит подписку на /events, пока не закроют stop, и после
+// каждого события поднимает latest до его ревизии и кладёт сигнал в notify
+// (не блокируясь: одного необработанного сигнала достаточно, ревизия не
+// теряется — она в latest). Обрывы переживает переподключением
+// с Last-Event-ID. Если сервер /events не умеет, просто выходит.
+func watchEvents(serverURL, token string, stop <-chan struct{}, notify chan<- struct{}, latest *atomic.Int64) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	lastID := ""
+	backoff := eventsBackoffMin
+	for {
+		got, err := readEvents(ctx, serverURL, token, &lastID, notify, latest)
+		if hasStatus(err, http.StatusNotFound, http.StatusMethodNotAllowed) {
+			return
+		}
+		if got {
+			backoff = eventsBackoffMin
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, eventsBackoffMax)
+	}
+}
+
+// readEvents читает один поток до обрыва. got — пришло ли хоть одно событие.
+func readEvents(ctx context.Context, serverURL, token string, lastID *string, notify chan<- struct{}, latest *atomic.Int64) (got bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimRight(serverURL, "/")+"/events", nil)
+	if err != nil {
+		return false, err
+	}
+	setAuth(req, token)
+	req.Header.Set("Accept", "text/event-stream")
+	if *lastID != "" {
+		req.Header.Set("Last-Event-ID", *lastID)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, statusError(resp)
+	}
+
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 0, 64<<10), maxEventLine)
+	id, data := "", ""
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "":
+			// Конец события
+			if data != "" {
+				var ev revisionEvent
+				if json.Unmarshal([]byte(data), &ev) == nil {
+					got = true
+					if id != "" {
+						*lastID = id
+					}
+					raiseTo(latest, ev.Revision)
+					select {
+					case notify <- struct{}{}:
+					default:
+					}
+				}
+			}
+			id, data = "", ""
+		case strings.HasPrefix(line, ":"):
+			// комментарий‑пинг
+		case strings.HasPrefix(line, "id:"):
+			id = strings.TrimSpace(strings.TrimPrefix(line, "id:"))
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")
+		}
+	}
+	return got, sc.Err()
+}
+
+// raiseTo поднимает v до rev, если rev больше
+func raiseTo(v *atomic.Int64, rev int64) {
+	for cur := v.Load(); rev > cur; cur = v.Load() {
+		if v.CompareAndSwap(cur, rev) {
+			return
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReadEventsLatestRevision(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ": ping\n\n")
+		for _, rev := range []int{3, 5, 4} {
+			fmt.Fprintf(w, "id: %d\nevent: revision\ndata: {\"revision\":%d,\"paths\":[]}\n\n", rev, rev)
+		}
+		fmt.Fprint(w, "data: not json\n\n")
+	}))
+	defer srv.Close()
+
+	notify := make(chan struct{}, 1)
+	var latest atomic.Int64
+	latest.Store(noRevision)
+	lastID := ""
+	got, err := readEvents(context.Background(), srv.URL, "tok", &lastID, notify, &latest)
+	if err != nil || !got {
+		t.Fatalf("got %v, err %v", got, err)
+	}
+	// Ревизия не откатывается назад, даже если события пришли не по порядку
+	if rev := latest.Load(); rev != 5 {
+		t.Errorf("latest = %d, want 5", rev)
+	}
+	if lastID != "4" {
+		t.Errorf("Last-Event-ID = %q, want 4", lastID)
+	}
+	select {
+	case <-notify:
+	default:
+		t.Error("no notification")
+	}
+}
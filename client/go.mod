@@ -3,7 +3,11 @@ module syncerch_client
 go 1.24.6
 
 require (
-	github.com/eiannone/keyboard v0.0.0-20220611211555-0d226195f203 // indirect
+	github.com/eiannone/keyboard v0.0.0-20220611211555-0d226195f203
+	github.com/fsnotify/fsnotify v1.9.0
+)
+
+require (
 	github.com/gdamore/encoding v1.0.1 // indirect
 	github.com/gdamore/tcell/v2 v2.8.1 // indirect
 	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
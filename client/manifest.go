@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Служебный каталог клиента внутри синхронизируемой папки — никогда не синхронизируется
+const internalDir = ".syncerch"
+
+// Сервер слишком старый и не умеет манифест/дельты
+var errDeltaUnsupported = errors.New("server does not support delta sync")
+
+// FileEntry — описание одного файла (формат совпадает с серверным /manifest)
+type FileEntry struct {
+	Path    string      `json:"path"`
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"mtime"`
+	Mode    os.FileMode `json:"mode"`
+	SHA256  string      `json:"sha256"`
+}
+
+type Manifest struct {
+	Files    []FileEntry `json:"files"`
+	Revision int64       `json:"-"` // ревизия vault на сервере, см. revision.go
+}
+
+// byPath — индекс манифеста по относительному пути
+func (m Manifest) byPath() map[string]FileEntry {
+	idx := make(map[string]FileEntry, len(m.Files))
+	for _, f := range m.Files {
+		idx[f.Path] = f
+	}
+	return idx
+}
+
+func localManifest(folderPath string) (Manifest, error) {
+	root := filepath.Clean(folderPath)
+	files := []FileEntry{}
+	cache := loadHashCache(root)
+	fresh := make(map[string]cachedHash)
+	start := time.Now()
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path == filepath.Join(root, internalDir) {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if isKeyFile(rel) {
+			return nil
+		}
+		e := FileEntry{
+			Path:    rel,
+			Size:    info.Size(),
+			ModTime: info.ModTime().UTC(),
+			Mode:    info.Mode().Perm(),
+		}
+		if c, ok := cache.Files[rel]; ok && c.Size == e.Size && c.ModTime.Equal(e.ModTime) {
+			e.SHA256 = c.SHA256
+		} else if e.SHA256, err = localHash(path, rel); err != nil {
+			return err
+		}
+		// Файл, изменённый только что, может поменяться ещё раз в ту же
+		// секунду с тем же размером — такой хэш в кэш не кладём
+		if start.Sub(e.ModTime) > 2*time.Second {
+			fresh[rel] = cachedHash{Size: e.Size, ModTime: e.ModTime, SHA256: e.SHA256}
+		}
+		files = append(files, e)
+		return nil
+	})
+	if err != nil {
+		return Manifest{}, err
+	}
+	saveHashCache(root, fresh)
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return Manifest{Files: files}, nil
+}
+
+// localHash — хэш, с которым файл сравнивается с сервером: SHA-256 содержимого,
+// а в зашифрованном vault — SHA-256 его шифротекста (rel нужен для siv)
+func localHash(path, rel string) (string, error) {
+	if vaultCrypt == nil {
+		return fileSHA256(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return vaultCrypt.cipherSHA256(f, rel)
+}
+
+// Кэш хэшей в <папка>/.syncerch/hashes.json: файл с прежними размером и mtime
+// не перечитывается. Кэш привязан к ключу шифрования — при смене ключа сбрасывается.
+const hashCacheFile = "hashes.json"
+
+type cachedHash struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256"`
+}
+
+type hashCache struct {
+	Key   string                `json:"key"` // отпечаток ключа, пусто — без шифрования
+	Files map[string]cachedHash `json:"files"`
+}
+
+func hashCacheKey() string {
+	if vaultCrypt == nil {
+		return ""
+	}
+	return vaultCrypt.id()
+}
+
+func loadHashCache(root string) hashCache {
+	var c hashCache
+	data, err := os.ReadFile(filepath.Join(root, internalDir, hashCacheFile))
+	if err != nil || json.Unmarshal(data, &c) != nil || c.Key != hashCacheKey() {
+		return hashCache{}
+	}
+	return c
+}
+
+// saveHashCache — кэш не критичен, ошибки записи игнорируются
+func saveHashCache(root string, files map[string]cachedHash) {
+	dir := filepath.Join(root, internalDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	data, err := json.Marshal(hashCache{Key: hashCacheKey(), Files: files})
+	if err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(dir, "hashes-*.json")
+	if err != nil {
+		return
+	}
+	_, werr := tmp.Write(data)
+	if cerr := tmp.Close(); werr != nil || cerr != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	if os.Rename(tmp.Name(), filepath.Join(dir, hashCacheFile)) != nil {
+		os.Remove(tmp.Name())
+	}
+}
+
+func fetchManifest(serverURL, token string) (Manifest, error) {
+	req, err := http.NewRequest("GET", strings.TrimRight(serverURL, "/")+"/manifest", nil)
+	if err != nil {
+		return Manifest{}, err
+	}
+	setAuth(req, token)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return Manifest{}, errDeltaUnsupported
+	}
+	if err := checkResponse(resp); err != nil {
+		return Manifest{}, err
+	}
+	var m Manifest
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return Manifest{}, fmt.Errorf("bad manifest: %w", err)
+	}
+	rev := responseRevision(resp)
+	m.Revision = rev
+	if vaultCrypt != nil {
+		// Ревизия нужна и при ошибке: первое шифрование vault — тоже запись
+		plain, err := vaultCrypt.decryptManifest(m)
+		plain.Revision = rev
+		return plain, err
+	}
+	for _, f := range m.Files {
+		if isKeyFile(f.Path) {
+			return Manifest{}, errVaultEncrypted
+		}
+	}
+	return m, nil
+}
+
+// setAuth добавляет токен в запрос. Если в настройках уже указана схема
+// ("Basic ...", "Bearer ..."), значение уходит как есть.
+func setAuth(req *http.Request, token string) {
+	if strings.Contains(strings.TrimSpace(token), " ") {
+		req.Header.Set("Authorization", strings.TrimSpace(token))
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+}
+
+// checkResponse превращает не‑200 ответ сервера в ошибку с его текстом
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	if err := revisionConflict(resp); err != nil {
+		return err
+	}
+	data, _ := io.ReadAll(resp.Body)
+	return fmt.Errorf("server error: %s", string(data))
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
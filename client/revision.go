@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Ревизия vault, на которой основана операция: приходит в X-Syncerch-Revision
+// ответа /manifest и уходит в If-Match каждого запроса на запись. Если vault
+// за это время изменил кто‑то другой, сервер отвечает 409 и ничего не
+// перезаписывает — клиент сообщает о конфликте (sync просто начинает заново).
+const revisionHeader = "X-Syncerch-Revision"
+
+// noRevision — сервер ревизий не знает, If-Match не отправляем
+const noRevision = -1
+
+// revisionConflictError — vault на сервере изменился после того, как
+// операция прочитала его манифест
+type revisionConflictError struct {
+	Current int64 // текущая ревизия сервера
+	msg     string
+}
+
+func (e *revisionConflictError) Error() string {
+	return "write conflict: " + e.msg
+}
+
+// responseRevision — ревизия из ответа сервера или noRevision
+func responseRevision(resp *http.Response) int64 {
+	rev, err := strconv.ParseInt(resp.Header.Get(revisionHeader), 10, 64)
+	if err != nil || rev < 0 {
+		return noRevision
+	}
+	return rev
+}
+
+// setIfMatch добавляет в запрос на запись ревизию, на которой он основан
+func setIfMatch(req *http.Request, base int64) {
+	if base != noRevision {
+		req.Header.Set("If-Match", fmt.Sprintf(`"%d"`, base))
+	}
+}
+
+// revisionConflict распознаёт 409 из‑за устаревшей ревизии (в ответе есть
+// текущая ревизия) — другие 409, например о недостающих кусках, не подходят
+func revisionConflict(resp *http.Response) error {
+	current := responseRevision(resp)
+	if resp.StatusCode != http.StatusConflict || current == noRevision {
+		return nil
+	}
+	data, _ := io.ReadAll(resp.Body)
+	var body struct {
+		Error string `json:"error"`
+	}
+	msg := strings.TrimSpace(string(data))
+	if json.Unmarshal(data, &body) == nil && body.Error != "" {
+		msg = body.Error
+	}
+	return &revisionConflictError{Current: current, msg: msg}
+}
+
+// isRevisionConflict — ошибка означает, что vault успели изменить
+func isRevisionConflict(err error) bool {
+	var rc *revisionConflictError
+	return errors.As(err, &rc)
+}
+
+// conflictStatus — строка для TUI, если запись отклонена из‑за конфликта ревизий
+func conflictStatus(err error) (string, bool) {
+	var rc *revisionConflictError
+	if !errors.As(err, &rc) {
+		return "", false
+	}
+	return fmt.Sprintf("на сервере появились чужие изменения (ревизия %d), ничего не перезаписано — сделайте sync и повторите", rc.Current), true
+}
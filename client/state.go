@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const stateFile = "state.json"
+
+// syncState хранится в <папка>/.syncerch/state.json.
+// Synced — манифест на момент последней успешной синхронизации:
+// по нему отличаем «удалено на сервере» от «есть только локально».
+type syncState struct {
+	Synced Manifest `json:"synced"`
+}
+
+func loadState(folderPath string) (syncState, error) {
+	var st syncState
+	data, err := os.ReadFile(filepath.Join(folderPath, internalDir, stateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return st, nil // ещё ни разу не синхронизировались
+	}
+	if err != nil {
+		return st, err
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return syncState{}, err
+	}
+	return st, nil
+}
+
+// saveState пишет состояние через временный файл, чтобы обрыв не оставил битый JSON
+func saveState(folderPath string, st syncState) error {
+	dir := filepath.Join(folderPath, internalDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "state-*.json")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, stateFile))
+}
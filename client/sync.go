@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// syncReport — итог двусторонней синхронизации
+type syncReport struct {
+	Pushed        int      // отправлено на сервер
+	Pulled        int      // получено с сервера
+	DeletedRemote int      // удалено на сервере
+	DeletedLocal  int      // удалено локально
+	Conflicts     []string // созданные конфликтные копии
+	Sent          int64    // байт кусков ушло на сервер, -1 — изменения ушли архивом
+	Revision      int64    // ревизия сервера, с которой теперь совпадает папка, или noRevision
+}
+
+func (r syncReport) summary() string {
+	if r.Pushed+r.Pulled+r.DeletedRemote+r.DeletedLocal == 0 && len(r.Conflicts) == 0 {
+		return "изменений нет"
+	}
+	s := fmt.Sprintf("отправлено: %d, получено: %d, удалено на сервере: %d, удалено локально: %d",
+		r.Pushed, r.Pulled, r.DeletedRemote, r.DeletedLocal)
+	if r.Sent >= 0 && r.Pushed > 0 {
+		s += ", передано: " + formatSize(r.Sent)
+	}
+	if len(r.Conflicts) > 0 {
+		s += fmt.Sprintf("; конфликты (%d): %s", len(r.Conflicts), strings.Join(r.Conflicts, ", "))
+	}
+	return s
+}
+
+// sameEntry — совпадают ли две версии файла (отсутствие файла тоже версия)
+func sameEntry(a FileEntry, aOK bool, b FileEntry, bOK bool) bool {
+	if aOK != bOK {
+		return false
+	}
+	return !aOK || a.SHA256 == b.SHA256
+}
+
+// syncFolder — трёхсторонняя синхронизация: базой служит манифест прошлой
+// синхронизации из state.json. Изменённое только локально уходит на сервер,
+// изменённое только на сервере приезжает сюда. Если файл изменён с обеих сторон
+// по‑разному, локальная версия переименовывается в конфликтную копию и тоже
+// отправляется на сервер, а под исходным именем остаётся серверная версия.
+// Правка побеждает удаление: такой файл возвращается туда, где его удалили.
+// Если между чтением манифеста и отправкой изменений vault изменил кто‑то
+// ещё (сервер ответил конфликтом ревизий), синхронизация начинается заново.
+func syncFolder(serverURL, token, folderPath string) (syncReport, error) {
+	var rep syncReport
+	var err error
+	var conflicts []string
+	for attempt := 0; attempt < syncAttempts; attempt++ {
+		rep, err = syncOnce(serverURL, token, folderPath)
+		conflicts = append(conflicts, rep.Conflicts...)
+		if !isRevisionConflict(err) {
+			break
+		}
+	}
+	rep.Conflicts = conflicts
+	return rep, err
+}
+
+// syncAttempts — сколько раз syncFolder пробует при конфликте ревизий
+const syncAttempts = 3
+
+// syncOnce — один проход syncFolder по манифесту одной ревизии
+func syncOnce(serverURL, token, folderPath string) (syncReport, error) {
+	rep := syncReport{Revision: noRevision}
+
+	remote, err := fetchManifest(serverURL, token)
+	if errors.Is(err, errDeltaUnsupported) {
+		return rep, errors.New("server does not support sync, use upload/download")
+	}
+	if err != nil {
+		return rep, err
+	}
+	rep.Revision = remote.Revision
+	local, err := localManifest(folderPath)
+	if err != nil {
+		return rep, err
+	}
+	state, err := loadState(folderPath)
+	if err != nil {
+		return rep, err
+	}
+
+	baseIdx, localIdx, remoteIdx := state.Synced.byPath(), local.byPath(), remote.byPath()
+	paths := make(map[string]struct{})
+	for _, idx := range []map[string]FileEntry{baseIdx, localIdx, remoteIdx} {
+		for p := range idx {
+			paths[p] = struct{}{}
+		}
+	}
+
+	var push, pushDelete, pullDelete, conflicts []string
+	var pull []FileEntry
+	synced := make(map[string]FileEntry) // база для следующего раза
+
+	for p := range paths {
+		b, bOK := baseIdx[p]
+		l, lOK := localIdx[p]
+		r, rOK := remoteIdx[p]
+		localChanged := !sameEntry(b, bOK, l, lOK)
+		remoteChanged := !sameEntry(b, bOK, r, rOK)
+
+		switch {
+		case !localChanged && !remoteChanged:
+			if bOK {
+				synced[p] = b
+			}
+		case localChanged && !remoteChanged:
+			if lOK {
+				push = append(push, p)
+				synced[p] = l
+			} else {
+				pushDelete = append(pushDelete, p)
+			}
+		case !localChanged && remoteChanged:
+			if rOK {
+				pull = append(pull, r)
+				synced[p] = r
+			} else {
+				pullDelete = append(pullDelete, p)
+			}
+		case sameEntry(l, lOK, r, rOK):
+			// Обе стороны пришли к одному и тому же
+			if lOK {
+				synced[p] = l
+			}
+		case lOK && rOK:
+			conflicts = append(conflicts, p)
+			pull = append(pull, r)
+			synced[p] = r
+		case lOK:
+			// На сервере удалён, локально изменён
+			push = append(push, p)
+			synced[p] = l
+		default:
+			// Локально удалён, на сервере изменён
+			pull = append(pull, r)
+			synced[p] = r
+		}
+	}
+
+	sort.Strings(conflicts)
+	for _, p := range conflicts {
+		cp, err := moveToConflictCopy(folderPath, p)
+		if err != nil {
+			return rep, fmt.Errorf("%s: %w", p, err)
+		}
+		l := localIdx[p]
+		l.Path = cp
+		push = append(push, cp)
+		synced[cp] = l
+		rep.Conflicts = append(rep.Conflicts, cp)
+	}
+
+	if len(push) > 0 || len(pushDelete) > 0 {
+		sort.Strings(push)
+		sent, err := sendChanges(serverURL, token, folderPath, push, pushDelete, remote.Revision)
+		if err != nil {
+			return rep, err
+		}
+		rep.Sent = sent
+		rep.Pushed, rep.DeletedRemote = len(push), len(pushDelete)
+		if remote.Revision != noRevision {
+			// Запись с If-Match на remote.Revision прошла — значит, между ними
+			// ничего не было и она дала ровно следующую ревизию
+			rep.Revision = remote.Revision + 1
+		}
+	}
+
+	// Базу сохраняем даже при ошибке скачивания: отправленное уже на сервере
+	save := func() error {
+		m := Manifest{Files: make([]FileEntry, 0, len(synced))}
+		for _, f := range synced {
+			m.Files = append(m.Files, f)
+		}
+		sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Path < m.Files[j].Path })
+		return saveState(folderPath, syncState{Synced: m})
+	}
+
+	for i, f := range pull {
+		if err := fetchFile(serverURL, token, folderPath, f); err != nil {
+			for _, rest := range pull[i:] {
+				restoreBase(synced, baseIdx, rest.Path)
+			}
+			for _, p := range pullDelete {
+				restoreBase(synced, baseIdx, p)
+			}
+			_ = save()
+			return rep, fmt.Errorf("%s: %w", f.Path, err)
+		}
+		rep.Pulled++
+	}
+	for i, p := range pullDelete {
+		if err := removeLocal(folderPath, p); err != nil {
+			for _, rest := range pullDelete[i:] {
+				restoreBase(synced, baseIdx, rest)
+			}
+			_ = save()
+			return rep, err
+		}
+		rep.DeletedLocal++
+	}
+
+	return rep, save()
+}
+
+// restoreBase откатывает запись базы для пути, который так и не удалось синхронизировать
+func restoreBase(synced, base map[string]FileEntry, p string) {
+	if b, ok := base[p]; ok {
+		synced[p] = b
+	} else {
+		delete(synced, p)
+	}
+}
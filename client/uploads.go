@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Докачиваемая загрузка архива: сервер заводит сессию, архив уходит кусками
+// по uploadChunkSize, каждый кусок повторяется при сбое сети. Сессия
+// запоминается в .syncerch/upload-session.json: если загрузка оборвалась
+// совсем, следующая попытка с тем же архивом (zip собирается детерминированно)
+// отправит только недостающие куски.
+const uploadSessionFile = "upload-session.json"
+
+const (
+	uploadChunkSize = 8 << 20
+	chunkRetries    = 5
+	// Дольше ждать по Retry-After нет смысла: сервер, скорее всего, забанил
+	// адрес за неудачные попытки входа, и повтор ничего не даст
+	maxRetryAfter = 30 * time.Second
+)
+
+// errChunkedUnsupported — старый сервер без /uploads, отправляем одним запросом
+var errChunkedUnsupported = errors.New("server does not support resumable uploads")
+
+type uploadSession struct {
+	ID        string `json:"id"`
+	URL       string `json:"url"` // vault, в который шла загрузка
+	Kind      string `json:"kind"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+	ChunkSize int64  `json:"chunk_size"`
+}
+
+// uploadStatus — ответ сервера о сессии
+type uploadStatus struct {
+	ID        string `json:"id"`
+	ChunkSize int64  `json:"chunk_size"`
+	Chunks    int    `json:"chunks"`
+	Missing   []int  `json:"missing"`
+}
+
+// httpStatusError — ответ сервера с кодом, по которому решаем, что делать дальше
+type httpStatusError struct {
+	code       int
+	msg        string
+	retryAfter time.Duration // из заголовка Retry-After, если он был
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("server error: %s", e.msg)
+}
+
+func statusError(resp *http.Response) error {
+	if err := revisionConflict(resp); err != nil {
+		return err
+	}
+	data, _ := io.ReadAll(resp.Body)
+	return &httpStatusError{code: resp.StatusCode, msg: strings.TrimSpace(string(data)), retryAfter: retryAfter(resp)}
+}
+
+// retryAfter разбирает Retry-After: число секунд или HTTP-дата
+func retryAfter(resp *http.Response) time.Duration {
+	v := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+// retryable — сбой сети или временная ошибка сервера
+func retryable(err error) bool {
+	if isRevisionConflict(err) {
+		return false
+	}
+	var se *httpStatusError
+	if !errors.As(err, &se) {
+		return true
+	}
+	if se.retryAfter > maxRetryAfter {
+		return false
+	}
+	return se.code >= 500 || se.code == http.StatusTooManyRequests
+}
+
+func hasStatus(err error, codes ...int) bool {
+	var se *httpStatusError
+	if !errors.As(err, &se) {
+		return false
+	}
+	for _, code := range codes {
+		if se.code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// sendArchive загружает zip‑архив докачиваемыми кусками и применяет его:
+// kind=replace — как /upload, kind=delta — как /delta со списком deleted.
+// rev — ревизия vault, на которой основан архив. Если сервер не умеет
+// /uploads, возвращает errChunkedUnsupported.
+func sendArchive(serverURL, token, folderPath, zipPath, kind string, deleted []string, rev int64) error {
+	info, err := os.Stat(zipPath)
+	if err != nil {
+		return err
+	}
+	sum, err := fileSHA256(zipPath)
+	if err != nil {
+		return err
+	}
+	base := strings.TrimRight(serverURL, "/") + "/uploads"
+
+	// Продолжаем прошлую сессию, если архив тот же самый
+	var st uploadStatus
+	saved, ok := loadUploadSession(folderPath)
+	if ok && saved.URL == serverURL && saved.Kind == kind && saved.Size == info.Size() && saved.SHA256 == sum {
+		err = uploadJSON("GET", base+"/"+saved.ID, token, noRevision, nil, &st)
+		if hasStatus(err, http.StatusNotFound, http.StatusForbidden) {
+			st = uploadStatus{} // сессия истекла или чужая — начинаем заново
+		} else if err != nil {
+			return err
+		}
+	}
+	if st.ID == "" {
+		req := map[string]any{"kind": kind, "size": info.Size(), "sha256": sum, "chunk_size": uploadChunkSize}
+		err := uploadJSON("POST", base, token, rev, req, &st)
+		if hasStatus(err, http.StatusNotFound, http.StatusMethodNotAllowed) {
+			return errChunkedUnsupported
+		}
+		if err != nil {
+			return err
+		}
+		saved = uploadSession{ID: st.ID, URL: serverURL, Kind: kind, Size: info.Size(), SHA256: sum, ChunkSize: st.ChunkSize}
+		if err := saveUploadSession(folderPath, saved); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Open(zipPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, n := range st.Missing {
+		off := int64(n) * st.ChunkSize
+		chunk := io.NewSectionReader(f, off, min(st.ChunkSize, info.Size()-off))
+		err := withRetries(func() error {
+			return putChunk(base+"/"+st.ID, token, n, chunk)
+		})
+		if hasStatus(err, http.StatusNotFound, http.StatusForbidden) {
+			removeUploadSession(folderPath)
+		}
+		if err != nil {
+			return fmt.Errorf("chunk %d/%d: %w", n+1, st.Chunks, err)
+		}
+	}
+
+	// Коммит не повторяем: при обрыве неизвестно, применился ли он.
+	// Следующая попытка увидит, что сессии уже нет, и начнёт заново.
+	if deleted == nil {
+		deleted = []string{}
+	}
+	err = uploadJSON("POST", base+"/"+st.ID+"/commit", token, rev, map[string]any{"deleted": deleted}, nil)
+	if err == nil || !retryable(err) {
+		removeUploadSession(folderPath)
+	}
+	return err
+}
+
+// multipartBody отдаёт тело multipart‑запроса, которое пишется на лету через
+// io.Pipe: поля fields, затем файл path (если задан) в части fileField.
+// Архив не копируется в память, сколько бы он ни весил. Закрытие тела
+// останавливает запись, если запрос оборвался.
+func multipartBody(fields map[string]string, fileField, path string) (io.ReadCloser, string) {
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeMultipart(writer, fields, fileField, path))
+	}()
+	return pr, writer.FormDataContentType()
+}
+
+func writeMultipart(writer *multipart.Writer, fields map[string]string, fileField, path string) error {
+	for name, value := range fields {
+		if err := writer.WriteField(name, value); err != nil {
+			return err
+		}
+	}
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		part, err := writer.CreateFormFile(fileField, filepath.Base(path))
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(part, f); err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+// withRetries повторяет fn при сетевых и временных ошибках с растущей паузой;
+// если сервер прислал Retry-After (429, 503), ждёт не меньше него
+func withRetries(fn func() error) error {
+	var err error
+	for attempt := 0; attempt < chunkRetries; attempt++ {
+		if attempt > 0 {
+			pause := time.Duration(1<<(attempt-1)) * time.Second
+			var se *httpStatusError
+			if errors.As(err, &se) {
+				pause = max(pause, se.retryAfter)
+			}
+			time.Sleep(pause)
+		}
+		if err = fn(); err == nil || !retryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func putChunk(sessionURL, token string, n int, chunk *io.SectionReader) error {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(chunk, 0, chunk.Size())); err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", fmt.Sprintf("%s/chunks/%d", sessionURL, n), io.NewSectionReader(chunk, 0, chunk.Size()))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = chunk.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Chunk-SHA256", hex.EncodeToString(h.Sum(nil)))
+	setAuth(req, token)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+	return nil
+}
+
+// uploadJSON отправляет body как JSON и разбирает ответ в out (если не nil).
+// rev уходит в If-Match, noRevision — не уходит.
+func uploadJSON(method, url, token string, rev int64, body, out any) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	setAuth(req, token)
+	setIfMatch(req, rev)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return statusError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func loadUploadSession(folderPath string) (uploadSession, bool) {
+	var s uploadSession
+	data, err := os.ReadFile(filepath.Join(folderPath, internalDir, uploadSessionFile))
+	if err != nil || json.Unmarshal(data, &s) != nil || s.ID == "" {
+		return uploadSession{}, false
+	}
+	return s, true
+}
+
+func saveUploadSession(folderPath string, s uploadSession) error {
+	dir := filepath.Join(folderPath, internalDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, uploadSessionFile), data, 0644)
+}
+
+func removeUploadSession(folderPath string) {
+	_ = os.Remove(filepath.Join(folderPath, internalDir, uploadSessionFile))
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eiannone/keyboard"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Режим слежения: папка слушается через fsnotify (inotify на Linux), пачка
+// правок схлопывается в одну синхронизацию через watchDebounce после
+// последней правки (но не позже watchMaxDelay после первой — автосохранение
+// редактора не должно откладывать её бесконечно). Изменения на сервере
+// приходят потоком /events (см. events.go), а на случай его обрыва или
+// старого сервера — ещё и опросом раз в watchPoll.
+const (
+	defaultWatchDebounce = 2 * time.Second
+	defaultWatchPoll     = 30 * time.Second
+	watchMaxDelayFactor  = 5 // watchMaxDelay = watchDebounce * watchMaxDelayFactor
+)
+
+// watchResult — итог одной синхронизации в режиме слежения
+type watchResult struct {
+	Time   time.Time
+	Reason string // start, local (правки в папке), remote (событие сервера), poll (опрос)
+	Report syncReport
+	Err    error
+}
+
+// watchTimings читает интервалы из конфига, по умолчанию 2s и 30s
+func (c Config) watchTimings() (debounce, poll time.Duration) {
+	debounce, poll = defaultWatchDebounce, defaultWatchPoll
+	if d, err := time.ParseDuration(c.WatchDebounce); err == nil && d > 0 {
+		debounce = d
+	}
+	if d, err := time.ParseDuration(c.WatchPoll); err == nil && d > 0 {
+		poll = d
+	}
+	return debounce, poll
+}
+
+// watchFolder синхронизирует папку при локальных правках и по таймеру, пока
+// не закроют stop. onSync вызывается после каждой синхронизации; ошибки
+// синхронизации слежение не прерывают, следующая попытка будет по таймеру.
+func watchFolder(cfg Config, stop <-chan struct{}, onSync func(watchResult)) error {
+	debounce, poll := cfg.watchTimings()
+	folder := filepath.Clean(cfg.FolderPath)
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return err
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if err := addWatchTree(w, folder); err != nil {
+		return err
+	}
+
+	// Ревизия, с которой папка совпадает после последней удачной синхронизации:
+	// событие о ней или о более старой (своя запись, приветствие при
+	// подключении) ничего нового не принесёт
+	synced := int64(noRevision)
+	syncNow := func(reason string) {
+		res := watchResult{Time: time.Now(), Reason: reason}
+		if err := openVaultCrypt(cfg); err != nil {
+			res.Err = err
+		} else {
+			res.Report, res.Err = syncFolder(cfg.vaultURL(), cfg.Token, folder)
+		}
+		if res.Err == nil {
+			synced = res.Report.Revision
+		}
+		// Каталоги, которые приехали с сервера, тоже надо слушать
+		if err := addWatchTree(w, folder); err != nil && res.Err == nil {
+			res.Err = err
+		}
+		onSync(res)
+	}
+
+	syncNow("start")
+
+	quit := make(chan struct{})
+	defer close(quit)
+	remote := make(chan struct{}, 1)
+	var remoteRev atomic.Int64
+	remoteRev.Store(noRevision)
+	go watchEvents(cfg.vaultURL(), cfg.Token, quit, remote, &remoteRev)
+
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	var pending <-chan time.Time // не nil, пока ждём конца пачки правок
+	var burstStart time.Time
+
+	for {
+		select {
+		case <-stop:
+			return nil
+
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if ignoredEvent(folder, ev) {
+				continue
+			}
+			if ev.Has(fsnotify.Create) {
+				if fi, err := os.Stat(ev.Name); err == nil && fi.IsDir() {
+					_ = addWatchTree(w, ev.Name)
+				}
+			}
+			now := time.Now()
+			if pending == nil {
+				burstStart = now
+			}
+			delay := min(debounce, burstStart.Add(debounce*watchMaxDelayFactor).Sub(now))
+			timer.Stop()
+			timer.Reset(max(delay, 0))
+			pending = timer.C
+
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			// Например, переполнение очереди inotify: какие‑то правки потеряны,
+			// синхронизация всё равно сравнит папку целиком
+			onSync(watchResult{Time: time.Now(), Reason: "watch", Err: err})
+			timer.Stop()
+			timer.Reset(debounce)
+			pending = timer.C
+
+		case <-pending:
+			pending = nil
+			syncNow("local")
+			ticker.Reset(poll)
+
+		case <-remote:
+			if synced != noRevision && remoteRev.Load() <= synced {
+				continue
+			}
+			// Если ждём конца пачки локальных правок, та синхронизация заберёт и эти
+			if pending == nil {
+				syncNow("remote")
+				ticker.Reset(poll)
+			}
+
+		case <-ticker.C:
+			if pending == nil {
+				syncNow("poll")
+			}
+		}
+	}
+}
+
+// addWatchTree подписывается на каталог root и все вложенные, кроме служебного
+func addWatchTree(w *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil // каталог успели удалить
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if d.Name() == internalDir {
+			return filepath.SkipDir
+		}
+		return w.Add(path)
+	})
+}
+
+// ignoredEvent — события, из‑за которых синхронизировать не нужно:
+// служебный каталог (его пишет сама синхронизация) и смена прав
+func ignoredEvent(folder string, ev fsnotify.Event) bool {
+	if ev.Op == fsnotify.Chmod {
+		return true
+	}
+	rel, err := filepath.Rel(folder, ev.Name)
+	if err != nil {
+		return true
+	}
+	first, _, _ := strings.Cut(filepath.ToSlash(rel), "/")
+	return first == internalDir || first == ".."
+}
+
+// watchStatus — строка статуса для TUI по итогу синхронизации
+func watchStatus(res watchResult) (string, string) {
+	at := res.Time.Format("15:04:05")
+	if msg, ok := conflictStatus(res.Err); ok {
+		return fmt.Sprintf("%s — %s", at, msg), brightYellow
+	}
+	if res.Err != nil {
+		return fmt.Sprintf("%s — ошибка: %v", at, res.Err), brightRed
+	}
+	if len(res.Report.Conflicts) > 0 {
+		return fmt.Sprintf("%s — %s", at, res.Report.summary()), brightYellow
+	}
+	return fmt.Sprintf("%s — %s", at, res.Report.summary()), brightGreen
+}
+
+// watchScreen держит режим слежения в TUI до нажатия любой клавиши и
+// возвращает итоговый статус для главного меню
+func watchScreen(selected int, cfg Config) (string, string) {
+	var mu sync.Mutex
+	stopped := false
+	last, lastColor := "", brightGreen
+	draw := func(status, color string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !stopped {
+			drawUI(selected, cfg, status+"\n"+dim+"Любая клавиша — остановить слежение"+reset, color)
+		}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	draw("Слежение: первая синхронизация...", brightYellow)
+	go func() {
+		done <- watchFolder(cfg, stop, func(res watchResult) {
+			status, color := watchStatus(res)
+			mu.Lock()
+			last, lastColor = status, color
+			mu.Unlock()
+			draw("Слежение за папкой. Последняя синхронизация: "+status, color)
+		})
+	}()
+
+	keys := keyPressed()
+	select {
+	case err := <-done:
+		// Слежение не запустилось (например, кончился лимит inotify)
+		mu.Lock()
+		stopped = true
+		mu.Unlock()
+		drawUI(selected, cfg, "Ошибка слежения: "+err.Error()+"\n"+dim+"Любая клавиша — назад"+reset, brightRed)
+		<-keys
+		return "Ошибка слежения: " + err.Error(), brightRed
+	case <-keys:
+	}
+
+	mu.Lock()
+	stopped = true
+	mu.Unlock()
+	drawUI(selected, cfg, "Остановка слежения...", brightYellow)
+	close(stop)
+	if err := <-done; err != nil {
+		return "Ошибка слежения: " + err.Error(), brightRed
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if last == "" {
+		return "Слежение остановлено", brightGreen
+	}
+	return "Слежение остановлено. Последняя синхронизация: " + last, lastColor
+}
+
+// keyPressed закрывается после нажатия любой клавиши
+func keyPressed() <-chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		_, _, _ = keyboard.GetKey()
+		close(ch)
+	}()
+	return ch
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Архив для /download собирается один раз на состояние vault и кэшируется
+// в <vault>/.syncerch/archives/<digest>.zip. digest — хэш списка файлов с их
+// размерами, mtime и SHA‑256; ETag — "<ревизия>-<digest>". Готовый файл отдаётся через
+// http.ServeContent: есть Content-Length, Range и If-Range, так что
+// оборванную загрузку клиент докачивает с того же места. Кэш занимает
+// столько же места, сколько сам vault, поэтому включается ARCHIVE_CACHE=true.
+const archivesDir = "archives"
+
+func archivesRoot(root string) string {
+	return filepath.Join(root, internalDir, archivesDir)
+}
+
+// archiveDigest описывает текущее дерево root одной строкой.
+// Вызывающий должен держать блокировку vault (хотя бы на чтение).
+func archiveDigest(root string) (digest string, files int, err error) {
+	root = filepath.Clean(root)
+	h := sha256.New()
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if d.IsDir() {
+			if rel == internalDir {
+				return filepath.SkipDir
+			}
+			fmt.Fprintf(h, "d %q\n", filepath.ToSlash(rel))
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		sum, err := cachedFileHash(path, info)
+		if err != nil {
+			return err
+		}
+		files++
+		fmt.Fprintf(h, "f %q %d %d %o %s\n", filepath.ToSlash(rel), info.Size(), info.ModTime().UnixNano(), info.Mode(), sum)
+		return nil
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32], files, nil
+}
+
+// cachedArchive возвращает путь к архиву текущего состояния vault, при
+// необходимости собирая его. Старые архивы удаляются: уже начатые загрузки
+// дочитают их из открытого файла, а докачка получит новый архив по If-Range.
+func cachedArchive(v *vault) (path, digest string, rev int64, files int, err error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	rev = v.revision()
+	digest, files, err = archiveDigest(v.root)
+	if err != nil {
+		return "", "", 0, 0, err
+	}
+	base := archivesRoot(v.root)
+	path = filepath.Join(base, digest+".zip")
+
+	// Замок свой у каждого vault: сборка большого архива не держит /download остальных
+	v.archiveMu.Lock()
+	defer v.archiveMu.Unlock()
+	if _, err := os.Stat(path); err == nil {
+		return path, digest, rev, files, nil
+	}
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return "", "", 0, 0, err
+	}
+	tmp, err := os.CreateTemp(base, ".tmp-*")
+	if err != nil {
+		return "", "", 0, 0, err
+	}
+	defer os.Remove(tmp.Name()) // после rename его уже нет
+	if _, err := writeArchive(tmp, v.root); err != nil {
+		tmp.Close()
+		return "", "", 0, 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", "", 0, 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", "", 0, 0, err
+	}
+
+	entries, _ := os.ReadDir(base)
+	for _, e := range entries {
+		if e.Name() != digest+".zip" && strings.HasSuffix(e.Name(), ".zip") {
+			if err := os.Remove(filepath.Join(base, e.Name())); err != nil {
+				log.Printf("remove old archive %s: %v", e.Name(), err)
+			}
+		}
+	}
+	return path, digest, rev, files, nil
+}
+
+// writeArchive пишет в w zip со всем деревом root, кроме служебного каталога
+func writeArchive(w io.Writer, root string) (files int, err error) {
+	zipWriter := zip.NewWriter(w)
+	defer func() {
+		if cerr := zipWriter.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, _ := filepath.Rel(root, path)
+		if info.IsDir() {
+			if relPath == "." {
+				return nil
+			}
+			if relPath == internalDir {
+				return filepath.SkipDir
+			}
+			relPath += "/"
+		}
+
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(relPath)
+		if !info.IsDir() {
+			header.Method = zip.Deflate
+		}
+
+		writer, err := zipWriter.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			_, copyErr := io.Copy(writer, f)
+			closeErr := f.Close()
+			if copyErr != nil {
+				return copyErr
+			}
+			if closeErr != nil {
+				return closeErr
+			}
+			files++
+		}
+		return nil
+	})
+	return files, err
+}
+
+// downloadHandler отдаёт весь vault одним zip. Без ARCHIVE_CACHE (по умолчанию)
+// архив не кэшируется и стримится на лету — без Content-Length и докачки.
+func downloadHandler(cfg Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v := currentVault(c)
+		c.Header("Content-Disposition", `attachment; filename="folder.zip"`)
+		c.Header("Content-Type", "application/zip")
+
+		if !cfg.ArchiveCache {
+			v.mu.RLock()
+			defer v.mu.RUnlock()
+			c.Header("Cache-Control", "no-store")
+			// Байты архива не кэшируются и докачать их нельзя, отсюда слабый ETag
+			rev := v.revision()
+			setRevision(c, rev)
+			c.Header("ETag", fmt.Sprintf(`W/"%d"`, rev))
+			files, err := writeArchive(c.Writer, v.root)
+			setAuditStats(c, files, int64(c.Writer.Size()))
+			if err != nil {
+				// Уже начали стримить, меняем только статус в логах
+				log.Printf("download error: %v", err)
+				_ = c.Error(err)
+			}
+			return
+		}
+
+		path, digest, rev, files, err := cachedArchive(v)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			// Архив успели заменить более новым между сборкой и открытием
+			c.Header("Retry-After", "1")
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "archive changed, retry"})
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		setRevision(c, rev)
+		c.Header("ETag", fmt.Sprintf(`"%d-%s"`, rev, digest))
+		c.Header("Cache-Control", "no-cache")
+		http.ServeContent(c.Writer, c.Request, "folder.zip", info.ModTime(), f)
+		setAuditStats(c, files, int64(c.Writer.Size()))
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Журнал аудита: JSON‑строка на каждую операцию с данными и на каждый отказ
+// в доступе. Нужен, чтобы понять, какой токен (устройство) и когда заменил vault.
+// Когда файл дорастает до AuditMaxBytes, он переименовывается в <путь>.1
+// (хранится одно прошлое поколение).
+
+// AuditEvent — одна запись журнала
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`  // upload, download, delta, restore, auth
+	Outcome   string    `json:"outcome"` // ok, denied, error
+	Status    int       `json:"status"`
+	TokenID   string    `json:"token_id,omitempty"`
+	TokenName string    `json:"token_name,omitempty"`
+	IP        string    `json:"ip"`
+	RemoteIP  string    `json:"remote_ip,omitempty"` // если IP взят из X-Forwarded-For
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Vault     string    `json:"vault,omitempty"`
+	Bytes     int64     `json:"bytes"`
+	Files     int       `json:"files"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// Ключи контекста, через которые обработчики передают объёмы в auditAction
+const (
+	auditFilesKey = "audit.files"
+	auditBytesKey = "audit.bytes"
+)
+
+var (
+	auditMu       sync.Mutex
+	auditFile     *os.File
+	auditPath     string
+	auditMaxBytes int64
+)
+
+// openAuditLog открывает журнал на дозапись. Пустой путь или "off" — журнал выключен.
+func openAuditLog(path string, maxBytes int64) error {
+	if path == "" || path == "off" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	auditMu.Lock()
+	auditFile, auditPath, auditMaxBytes = f, path, maxBytes
+	auditMu.Unlock()
+	return nil
+}
+
+func closeAuditLog() {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if auditFile != nil {
+		auditFile.Close()
+		auditFile = nil
+	}
+}
+
+// recordAudit дописывает событие в журнал. Ошибки записи только логируются:
+// из‑за журнала запросы не должны падать.
+func recordAudit(ev AuditEvent) {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("audit: %v", err)
+		return
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if auditFile == nil {
+		return
+	}
+	if auditMaxBytes > 0 {
+		if st, err := auditFile.Stat(); err == nil && st.Size()+int64(len(line)) > auditMaxBytes {
+			rotateAuditLog()
+		}
+	}
+	if _, err := auditFile.Write(append(line, '\n')); err != nil {
+		log.Printf("audit: %v", err)
+	}
+}
+
+// rotateAuditLog переносит текущий файл в <путь>.1 и начинает новый. Вызывается под auditMu.
+func rotateAuditLog() {
+	if err := os.Rename(auditPath, auditPath+".1"); err != nil {
+		log.Printf("audit rotate: %v", err)
+		return
+	}
+	f, err := os.OpenFile(auditPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("audit rotate: %v", err)
+		return
+	}
+	auditFile.Close()
+	auditFile = f
+}
+
+// newAuditEvent заполняет общие поля события из запроса
+func newAuditEvent(c *gin.Context, action string) AuditEvent {
+	ev := AuditEvent{
+		Time:   time.Now().UTC(),
+		Action: action,
+		IP:     c.ClientIP(),
+		Method: c.Request.Method,
+		Path:   c.Request.URL.Path,
+	}
+	if remote := c.RemoteIP(); remote != ev.IP {
+		ev.RemoteIP = remote
+	}
+	if v, ok := c.Get("token"); ok {
+		t := v.(tokenInfo)
+		ev.TokenID, ev.TokenName = t.ID, t.Name
+	}
+	if v, ok := c.Get("vault"); ok {
+		ev.Vault = v.(*vault).name
+	} else if name := c.Param("vault"); name != "" {
+		ev.Vault = name
+	}
+	return ev
+}
+
+// auditDenied записывает отказ в доступе, случившийся до обработчика
+func auditDenied(c *gin.Context, status int, reason string) {
+	ev := newAuditEvent(c, "auth")
+	ev.Outcome, ev.Status, ev.Reason = "denied", status, reason
+	recordAudit(ev)
+}
+
+// setAuditStats сообщает auditAction, сколько файлов и байт затронула операция
+func setAuditStats(c *gin.Context, files int, bytes int64) {
+	c.Set(auditFilesKey, files)
+	c.Set(auditBytesKey, bytes)
+}
+
+// auditAction пишет в журнал результат операции action после её выполнения.
+// Стоит перед requirePerm, чтобы отказы по правам тоже попадали в журнал.
+func auditAction(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		ev := newAuditEvent(c, action)
+		ev.Status = c.Writer.Status()
+		switch {
+		case ev.Status == http.StatusUnauthorized || ev.Status == http.StatusForbidden:
+			ev.Outcome = "denied"
+		case ev.Status >= 400:
+			ev.Outcome = "error"
+		default:
+			ev.Outcome = "ok"
+		}
+		ev.Files = c.GetInt(auditFilesKey)
+		ev.Bytes = c.GetInt64(auditBytesKey)
+		if len(c.Errors) > 0 { // ошибка после начала ответа, статус уже 200
+			ev.Outcome, ev.Reason = "error", c.Errors.Last().Error()
+		}
+		recordAudit(ev)
+		observeOperation(ev)
+	}
+}
+
+// auditHandler отдаёт последние записи журнала (новые первыми).
+// Фильтры: action, token (id или имя), vault, outcome, since (RFC 3339), limit (до 1000).
+// Токену, ограниченному vault'ами, видны только события этих vault'ов.
+func auditHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := 100
+		if s := c.Query("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+				return
+			}
+			limit = min(n, 1000)
+		}
+		var since time.Time
+		if s := c.Query("since"); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid since: " + err.Error()})
+				return
+			}
+			since = t
+		}
+		action, token, vaultName, outcome := c.Query("action"), c.Query("token"), c.Query("vault"), c.Query("outcome")
+		caller := currentToken(c)
+
+		match := func(ev AuditEvent) bool {
+			if ev.Vault == "" && caller.Vaults != nil || ev.Vault != "" && !caller.allowsVault(ev.Vault) {
+				return false
+			}
+			return (action == "" || ev.Action == action) &&
+				(token == "" || ev.TokenID == token || ev.TokenName == token) &&
+				(vaultName == "" || ev.Vault == vaultName) &&
+				(outcome == "" || ev.Outcome == outcome) &&
+				!ev.Time.Before(since)
+		}
+
+		// Под auditMu только открываем файлы, чтобы ротация не проскочила между
+		// ними; читаем уже без блокировки — иначе запрос журнала держал бы
+		// запись аудита всех остальных запросов. Ротация — это rename, открытые
+		// дескрипторы она не трогает.
+		auditMu.Lock()
+		var files []*os.File
+		var err error
+		if auditPath != "" {
+			files, err = openAuditFiles([]string{auditPath + ".1", auditPath})
+		}
+		auditMu.Unlock()
+		var events []AuditEvent
+		if err == nil {
+			events, err = readAuditEvents(files, match, limit)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Файлы читаются от старых к новым, отдаём от новых к старым
+		out := make([]AuditEvent, 0, len(events))
+		for i := len(events) - 1; i >= 0; i-- {
+			out = append(out, events[i])
+		}
+		c.JSON(http.StatusOK, gin.H{"events": out})
+	}
+}
+
+// openAuditFiles открывает существующие из paths
+func openAuditFiles(paths []string) ([]*os.File, error) {
+	var files []*os.File
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// readAuditEvents читает файлы по порядку, закрывает их и оставляет последние
+// limit подходящих событий
+func readAuditEvents(files []*os.File, match func(AuditEvent) bool, limit int) ([]AuditEvent, error) {
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var events []AuditEvent
+	for _, f := range files {
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64*1024), 1024*1024)
+		for sc.Scan() {
+			line := strings.TrimSpace(sc.Text())
+			if line == "" {
+				continue
+			}
+			var ev AuditEvent
+			if json.Unmarshal([]byte(line), &ev) != nil || !match(ev) {
+				continue
+			}
+			events = append(events, ev)
+			if len(events) > limit {
+				events = events[1:]
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Права токена
+const (
+	permRead  = 'r'
+	permWrite = 'w'
+	permAdmin = 'a' // чтение журнала аудита
+)
+
+// Префикс хэшированной записи в файле токенов: sha256:<hex>
+const tokenHashPrefix = "sha256:"
+
+// tokenInfo — что разрешено токену. Формат строки в файле токенов:
+//
+//	<токен | sha256:<hex>> [name=laptop] [perms=r|w|rw|rwa] [vault=notes,work]
+//
+// Строка из одного токена (старый формат) даёт полный доступ ко всем vault'ам.
+// Вместо самого токена можно хранить его хэш (см. hashToken) — тогда утёкший
+// файл токенов не даёт рабочих учётных данных. Такие строки пишет `server token add`.
+type tokenInfo struct {
+	ID     string // отпечаток: начало хэша токена, безопасно показывать и логировать
+	Name   string
+	Perms  string              // набор букв из permRead/permWrite/permAdmin
+	Vaults map[string]struct{} // nil — все vault'ы
+}
+
+// tokenEntry — строка файла токенов: хэш токена и его права
+type tokenEntry struct {
+	hash []byte
+	info tokenInfo
+}
+
+func (t tokenInfo) can(perm rune) bool {
+	return strings.ContainsRune(t.Perms, perm)
+}
+
+func (t tokenInfo) allowsVault(name string) bool {
+	if t.Vaults == nil {
+		return true
+	}
+	_, ok := t.Vaults[name]
+	return ok
+}
+
+var (
+	tokens     []tokenEntry
+	tokensLock sync.RWMutex
+
+	tokenPepper string // секрет для HMAC хэшей токенов (TOKEN_PEPPER), хранится не рядом с токенами
+)
+
+// hashToken — SHA-256 токена, а если задан перец — HMAC-SHA256 с ним
+func hashToken(token string) []byte {
+	if tokenPepper == "" {
+		sum := sha256.Sum256([]byte(token))
+		return sum[:]
+	}
+	m := hmac.New(sha256.New, []byte(tokenPepper))
+	m.Write([]byte(token))
+	return m.Sum(nil)
+}
+
+// Запасные места для токена (если включено TOKEN_FALLBACK) — для скачивания из браузера
+const (
+	tokenQueryParam = "token"
+	tokenCookie     = "syncerch_token"
+)
+
+func authMiddleware(cfg Config, lim *limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := extractToken(c, cfg.TokenFallback)
+		info, ok := checkToken(token)
+		if token == "" || !ok {
+			reason := "invalid token"
+			if token == "" {
+				reason = "missing token"
+			}
+			metricAuthFailures.inc(strings.ReplaceAll(reason, " ", "_"))
+			auditDenied(c, http.StatusUnauthorized, reason)
+			if ban := lim.authFailed(c.ClientIP()); ban > 0 {
+				auditDenied(c, http.StatusTooManyRequests, "banned for "+ban.String())
+			}
+			c.Header("WWW-Authenticate", `Bearer realm="syncerch"`)
+			c.Writer.Header().Add("WWW-Authenticate", `Basic realm="syncerch"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+			return
+		}
+		lim.authSucceeded(c.ClientIP())
+		c.Set("token", info)
+		c.Next()
+	}
+}
+
+// extractToken достаёт токен из запроса. Authorization понимается в виде
+// "Bearer <токен>", "Basic base64(user:<токен>)" или просто "<токен>" (старые клиенты).
+// Query-параметр и cookie смотрим только для GET/HEAD и только если это разрешено:
+// токен в URL оседает в логах, а cookie на POST открыли бы дорогу CSRF.
+func extractToken(c *gin.Context, fallback bool) string {
+	if auth := strings.TrimSpace(c.GetHeader("Authorization")); auth != "" {
+		scheme, rest, found := strings.Cut(auth, " ")
+		if !found {
+			return auth
+		}
+		switch strings.ToLower(scheme) {
+		case "bearer":
+			return strings.TrimSpace(rest)
+		case "basic":
+			user, pass, ok := c.Request.BasicAuth()
+			if !ok {
+				return ""
+			}
+			if pass == "" {
+				return user // curl -u <токен>:
+			}
+			return pass
+		default:
+			return auth
+		}
+	}
+	if !fallback || (c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead) {
+		return ""
+	}
+	if t := c.Query(tokenQueryParam); t != "" {
+		return t
+	}
+	if t, err := c.Cookie(tokenCookie); err == nil {
+		return t
+	}
+	return ""
+}
+
+func currentToken(c *gin.Context) tokenInfo {
+	return c.MustGet("token").(tokenInfo)
+}
+
+// requirePerm пропускает запрос, только если у токена есть право perm
+func requirePerm(perm rune) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !currentToken(c).can(perm) {
+			metricAuthFailures.inc("permission")
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("token lacks %q permission", perm)})
+			return
+		}
+		c.Next()
+	}
+}
+
+// checkPerms проверяет набор прав: пустой или с незнакомой буквой — ошибка
+func checkPerms(perms string) error {
+	if perms == "" {
+		return fmt.Errorf("perms must not be empty")
+	}
+	for _, p := range perms {
+		if p != permRead && p != permWrite && p != permAdmin {
+			return fmt.Errorf("unknown permission %q", p)
+		}
+	}
+	return nil
+}
+
+// parseTokenLine разбирает одну строку файла токенов
+func parseTokenLine(line string) (tokenEntry, error) {
+	fields := strings.Fields(line)
+	var e tokenEntry
+	if hexHash, ok := strings.CutPrefix(fields[0], tokenHashPrefix); ok {
+		h, err := hex.DecodeString(hexHash)
+		if err != nil || len(h) != sha256.Size {
+			return tokenEntry{}, fmt.Errorf("bad token hash")
+		}
+		e.hash = h
+	} else {
+		e.hash = hashToken(fields[0])
+	}
+
+	info := tokenInfo{
+		ID:    hex.EncodeToString(e.hash)[:12],
+		Perms: string([]rune{permRead, permWrite}),
+	}
+	for _, f := range fields[1:] {
+		key, val, ok := strings.Cut(f, "=")
+		if !ok {
+			return tokenEntry{}, fmt.Errorf("bad field %q", f)
+		}
+		switch key {
+		case "name":
+			info.Name = val
+		case "perms":
+			if err := checkPerms(val); err != nil {
+				return tokenEntry{}, err
+			}
+			info.Perms = val
+		case "vault", "vaults":
+			info.Vaults = make(map[string]struct{})
+			for _, v := range strings.Split(val, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					info.Vaults[v] = struct{}{}
+				}
+			}
+		default:
+			return tokenEntry{}, fmt.Errorf("unknown field %q", key)
+		}
+	}
+	e.info = info
+	return e, nil
+}
+
+func loadTokens(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		metricTokenReloads.inc("error")
+		log.Printf("no tokens loaded from %s: %v", path, err)
+		return
+	}
+	var list []tokenEntry
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		e, err := parseTokenLine(line)
+		if err != nil {
+			// Кривую строку пропускаем целиком: лучше отказать, чем дать лишние права
+			log.Printf("tokens %s:%d: %v, skipped", path, n+1, err)
+			continue
+		}
+		list = append(list, e)
+	}
+	tokensLock.Lock()
+	tokens = list
+	tokensLock.Unlock()
+	metricTokenReloads.inc("ok")
+	metricTokens.set(float64(len(list)))
+	log.Printf("tokens loaded: %d", len(list))
+}
+
+func watchTokens(ctx context.Context, path string, every time.Duration) {
+	if every <= 0 {
+		every = 5 * time.Second
+	}
+	var lastMod time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(every):
+			fi, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if fi.ModTime().After(lastMod) {
+				lastMod = fi.ModTime()
+				loadTokens(path)
+			}
+		}
+	}
+}
+
+// checkToken сравнивает хэш токена со всеми записями за постоянное время:
+// без раннего выхода и через subtle.ConstantTimeCompare
+func checkToken(token string) (tokenInfo, bool) {
+	h := hashToken(token)
+	tokensLock.RLock()
+	defer tokensLock.RUnlock()
+	var found tokenInfo
+	ok := 0
+	for _, e := range tokens {
+		if subtle.ConstantTimeCompare(e.hash, h) == 1 {
+			found = e.info
+			ok = 1
+		}
+	}
+	return found, ok == 1
+}
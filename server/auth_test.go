@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"maps"
+	"testing"
+)
+
+func TestParseTokenLine(t *testing.T) {
+	hash := hex.EncodeToString(hashToken("secret"))
+	tests := []struct {
+		line    string
+		name    string
+		perms   string
+		vaults  []string // nil — все vault'ы
+		wantErr bool
+	}{
+		{line: "secret", perms: "rw"},
+		{line: tokenHashPrefix + hash, perms: "rw"},
+		{line: "secret name=laptop perms=r", name: "laptop", perms: "r"},
+		{line: "secret perms=rwa vault=notes", perms: "rwa", vaults: []string{"notes"}},
+		{line: "secret vaults=a,b,,c", perms: "rw", vaults: []string{"a", "b", "c"}},
+		{line: "secret vault=", perms: "rw", vaults: []string{}},
+		{line: "secret perms=", wantErr: true},
+		{line: "secret perms=rx", wantErr: true},
+		{line: "secret perms=R", wantErr: true},
+		{line: "secret name", wantErr: true},
+		{line: "secret owner=me", wantErr: true},
+		{line: tokenHashPrefix + "abc", wantErr: true},
+		{line: tokenHashPrefix + hash + "zz", wantErr: true},
+	}
+	for _, tt := range tests {
+		e, err := parseTokenLine(tt.line)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: no error", tt.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+			continue
+		}
+		if !bytes.Equal(e.hash, hashToken("secret")) {
+			t.Errorf("%q: wrong hash", tt.line)
+		}
+		if e.info.Name != tt.name || e.info.Perms != tt.perms {
+			t.Errorf("%q: name %q perms %q, want %q %q", tt.line, e.info.Name, e.info.Perms, tt.name, tt.perms)
+		}
+		var want map[string]struct{}
+		if tt.vaults != nil {
+			want = map[string]struct{}{}
+			for _, v := range tt.vaults {
+				want[v] = struct{}{}
+			}
+		}
+		if (e.info.Vaults == nil) != (want == nil) || !maps.Equal(e.info.Vaults, want) {
+			t.Errorf("%q: vaults %v, want %v", tt.line, e.info.Vaults, tt.vaults)
+		}
+	}
+}
+
+func TestTokenScope(t *testing.T) {
+	tests := []struct {
+		line       string
+		read, wr   bool
+		admin      bool
+		vault      string
+		allowVault bool
+	}{
+		{line: "t", read: true, wr: true, vault: "any", allowVault: true},
+		{line: "t perms=r", read: true, vault: "default", allowVault: true},
+		{line: "t perms=a", admin: true, vault: "x", allowVault: true},
+		{line: "t vault=notes", read: true, wr: true, vault: "notes", allowVault: true},
+		{line: "t vault=notes", read: true, wr: true, vault: "default"},
+		{line: "t vaults=a,b", read: true, wr: true, vault: "b", allowVault: true},
+		{line: "t vault=", read: true, wr: true, vault: "default"},
+	}
+	for _, tt := range tests {
+		e, err := parseTokenLine(tt.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := e.info.can(permRead); got != tt.read {
+			t.Errorf("%q: can read = %v", tt.line, got)
+		}
+		if got := e.info.can(permWrite); got != tt.wr {
+			t.Errorf("%q: can write = %v", tt.line, got)
+		}
+		if got := e.info.can(permAdmin); got != tt.admin {
+			t.Errorf("%q: can admin = %v", tt.line, got)
+		}
+		if got := e.info.allowsVault(tt.vault); got != tt.allowVault {
+			t.Errorf("%q: allowsVault(%q) = %v", tt.line, tt.vault, got)
+		}
+	}
+}
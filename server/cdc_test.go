@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"slices"
+	"testing"
+	"testing/iotest"
+)
+
+// Те же векторы лежат в cdc_test.go второго модуля (клиент и сервер): если
+// поменять cdcSplit или gearTable только с одной стороны, куски перестанут
+// совпадать и дедупликация молча сломается — пусть лучше упадёт тест.
+
+// cdcStream — детерминированные псевдослучайные данные: SHA‑256(seed | счётчик)
+func cdcStream(seed string, n int) []byte {
+	out := make([]byte, 0, n+sha256.Size)
+	for i := uint64(0); len(out) < n; i++ {
+		sum := sha256.Sum256(binary.BigEndian.AppendUint64([]byte(seed), i))
+		out = append(out, sum[:]...)
+	}
+	return out[:n]
+}
+
+var cdcVectors = []struct {
+	name  string
+	data  []byte
+	sizes []int
+}{
+	{"empty", nil, nil},
+	{"short", cdcStream("tail", 10<<10), []int{10240}},
+	{"zeros", make([]byte, 600<<10), []int{262144, 262144, 90112}},
+	{"random", cdcStream("syncerch cdc", 1<<20), []int{46193, 85227, 99533, 25111, 36399, 133403, 29762, 66853, 90190, 67135, 103806, 69442, 128866, 66656}},
+}
+
+func cdcSizes(t *testing.T, r interface{ Read([]byte) (int, error) }) []int {
+	t.Helper()
+	var sizes []int
+	err := cdcSplit(r, func(chunk []byte) error {
+		sizes = append(sizes, len(chunk))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sizes
+}
+
+func TestCDCVectors(t *testing.T) {
+	for _, v := range cdcVectors {
+		if got := cdcSizes(t, bytes.NewReader(v.data)); !slices.Equal(got, v.sizes) {
+			t.Errorf("%s: chunk sizes %v, want %v", v.name, got, v.sizes)
+		}
+		// Границы зависят только от содержимого, а не от того, как его читают
+		if got := cdcSizes(t, iotest.HalfReader(bytes.NewReader(v.data))); !slices.Equal(got, v.sizes) {
+			t.Errorf("%s: chunk sizes with short reads %v, want %v", v.name, got, v.sizes)
+		}
+	}
+}
+
+func TestCDCGearTable(t *testing.T) {
+	h := sha256.New()
+	if err := binary.Write(h, binary.LittleEndian, gearTable); err != nil {
+		t.Fatal(err)
+	}
+	const want = "a50223b48328aad47d6a6dae4d1d7d21ec1e19d7bc419299354ffdc0007b108a"
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		t.Errorf("gear table digest %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,713 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Дедупликация по кускам. Дерево vault по‑прежнему хранится распакованным
+// (его читают /download и /files), а поверх него ведётся индекс: для каждого
+// файла — список его кусков (cdcSplit) по SHA‑256. Клиент режет изменённые
+// файлы так же, спрашивает POST /chunks/missing, каких кусков у сервера нет,
+// присылает только их (POST /chunks, zip с записями <sha256>) и коммитит
+// рецепты файлов (POST /chunks/commit). Сервер собирает файлы из кусков,
+// взятых из файлов дерева и из хранилища блоков .syncerch/blocks/<xx>/<sha256>,
+// и применяет их как дельту.
+//
+// Хранилище блоков общее для загрузок и истории. Любой кусок, на который
+// ссылается снапшот, лежит либо в файле текущего дерева, либо в блоке: перед
+// записью куски уходящих версий переносятся в блоки (preserveChunks), а блок
+// удаляется, когда на него не ссылается ни один снапшот (pruneBlobs, после
+// чистки снапшотов по ретенции). Так повторная загрузка того, что уже было
+// в истории, не передаёт ни байта, а снапшот стоит столько, сколько куски,
+// которых нет в дереве. Блок, пришедший от клиента, после коммита живёт в
+// файле и из хранилища убирается — место дважды не тратится.
+const (
+	blocksDir      = "blocks"
+	chunkIndexFile = "chunks.json"
+
+	maxChunkBatch = 64 << 20 // предел одного POST /chunks без MAX_UPLOAD_MB
+)
+
+var chunkHashRe = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+type chunkRef struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// fileRecipe — из каких кусков состоит файл дерева
+type fileRecipe struct {
+	Size    int64      `json:"size"`
+	ModTime time.Time  `json:"mtime"`
+	Chunks  []chunkRef `json:"chunks"`
+}
+
+// chunkLoc — где в дереве лежит кусок
+type chunkLoc struct {
+	rel       string
+	off, size int64
+}
+
+type chunkIndex struct {
+	mu     sync.Mutex
+	loaded bool
+	files  map[string]fileRecipe // по относительному пути
+	locs   map[string]chunkLoc   // по SHA‑256 куска
+}
+
+var (
+	chunkIndexes   = make(map[string]*chunkIndex)
+	chunkIndexesMu sync.Mutex
+)
+
+func vaultChunkIndex(root string) *chunkIndex {
+	chunkIndexesMu.Lock()
+	defer chunkIndexesMu.Unlock()
+	ix, ok := chunkIndexes[root]
+	if !ok {
+		ix = &chunkIndex{files: make(map[string]fileRecipe), locs: make(map[string]chunkLoc)}
+		chunkIndexes[root] = ix
+	}
+	return ix
+}
+
+func blocksRoot(root string) string {
+	return filepath.Join(root, internalDir, blocksDir)
+}
+
+func blobPath(root, hash string) string {
+	return filepath.Join(blocksRoot(root), hash[:2], hash)
+}
+
+// refresh приводит индекс в соответствие с деревом: режет новые и изменённые
+// файлы (по размеру и mtime, как кэш хэшей) и забывает удалённые. Индекс
+// сохраняется в .syncerch/chunks.json, чтобы после перезапуска не резать всё
+// заново. Вызывающий должен держать блокировку vault (хотя бы на чтение).
+func (ix *chunkIndex) refresh(root string) error {
+	root = filepath.Clean(root)
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	indexPath := filepath.Join(root, internalDir, chunkIndexFile)
+	if !ix.loaded {
+		if data, err := os.ReadFile(indexPath); err == nil {
+			if err := json.Unmarshal(data, &ix.files); err != nil {
+				log.Printf("chunk index %s: %v, rebuilding", indexPath, err)
+				ix.files = make(map[string]fileRecipe)
+			}
+		}
+		ix.loaded = true
+	}
+
+	changed := false
+	seen := make(map[string]struct{}, len(ix.files))
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path == filepath.Join(root, internalDir) {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		seen[rel] = struct{}{}
+		if r, ok := ix.files[rel]; ok && r.Size == info.Size() && r.ModTime.Equal(info.ModTime()) {
+			return nil
+		}
+		chunks, err := chunkFile(path)
+		if err != nil {
+			return err
+		}
+		ix.files[rel] = fileRecipe{Size: info.Size(), ModTime: info.ModTime(), Chunks: chunks}
+		changed = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for rel := range ix.files {
+		if _, ok := seen[rel]; !ok {
+			delete(ix.files, rel)
+			changed = true
+		}
+	}
+	ix.rebuildLocs()
+	if changed {
+		return ix.save(indexPath)
+	}
+	return nil
+}
+
+// learn записывает рецепты только что собранных файлов, чтобы не резать их
+// повторно. Вызывающий должен держать блокировку vault.
+func (ix *chunkIndex) learn(root string, files []chunkedFile) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if !ix.loaded {
+		return nil // индекса ещё нет, refresh построит его целиком
+	}
+	for _, f := range files {
+		info, err := os.Stat(filepath.Join(root, filepath.FromSlash(f.Path)))
+		if err != nil {
+			return err
+		}
+		ix.files[f.Path] = fileRecipe{Size: info.Size(), ModTime: info.ModTime(), Chunks: f.Chunks}
+	}
+	ix.rebuildLocs()
+	return ix.save(filepath.Join(root, internalDir, chunkIndexFile))
+}
+
+// rebuildLocs пересчитывает карту кусков. Вызывается под ix.mu.
+func (ix *chunkIndex) rebuildLocs() {
+	ix.locs = make(map[string]chunkLoc)
+	for rel, r := range ix.files {
+		var off int64
+		for _, ch := range r.Chunks {
+			if _, ok := ix.locs[ch.Hash]; !ok {
+				ix.locs[ch.Hash] = chunkLoc{rel: rel, off: off, size: ch.Size}
+			}
+			off += ch.Size
+		}
+	}
+}
+
+// save пишет индекс через временный файл. Вызывается под ix.mu.
+func (ix *chunkIndex) save(path string) error {
+	data, err := json.Marshal(ix.files)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (ix *chunkIndex) locate(hash string) (chunkLoc, bool) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	loc, ok := ix.locs[hash]
+	return loc, ok
+}
+
+// recipes возвращает копию рецептов дерева на момент последнего refresh
+func (ix *chunkIndex) recipes() map[string]fileRecipe {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	out := make(map[string]fileRecipe, len(ix.files))
+	for rel, r := range ix.files {
+		out[rel] = r
+	}
+	return out
+}
+
+// chunkFile режет файл на куски
+func chunkFile(path string) ([]chunkRef, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	chunks := []chunkRef{}
+	err = cdcSplit(f, func(chunk []byte) error {
+		sum := sha256.Sum256(chunk)
+		chunks = append(chunks, chunkRef{Hash: hex.EncodeToString(sum[:]), Size: int64(len(chunk))})
+		return nil
+	})
+	return chunks, err
+}
+
+// readChunk достаёт кусок из хранилища блоков или из файла дерева и сверяет
+// его хэш. fromBlob — кусок пришёл от клиента, а не был у сервера раньше.
+func readChunk(root string, ix *chunkIndex, ref chunkRef) (data []byte, fromBlob bool, err error) {
+	data, err = os.ReadFile(blobPath(root, ref.Hash))
+	fromBlob = err == nil
+	if errors.Is(err, fs.ErrNotExist) {
+		loc, ok := ix.locate(ref.Hash)
+		if !ok {
+			return nil, false, errChunkMissing
+		}
+		data = make([]byte, loc.size)
+		f, err := os.Open(filepath.Join(root, filepath.FromSlash(loc.rel)))
+		if err != nil {
+			return nil, false, err
+		}
+		_, err = f.ReadAt(data, loc.off)
+		f.Close()
+		if err != nil {
+			return nil, false, err
+		}
+	} else if err != nil {
+		return nil, false, err
+	}
+	sum := sha256.Sum256(data)
+	if int64(len(data)) != ref.Size || hex.EncodeToString(sum[:]) != ref.Hash {
+		return nil, false, fmt.Errorf("%w: %s", errChunkMissing, ref.Hash)
+	}
+	return data, fromBlob, nil
+}
+
+var errChunkMissing = errors.New("chunk not available")
+
+// missingChunksHandler: {"chunks": [sha256...]} → {"missing": [...]}
+func missingChunksHandler(cfg Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v := currentVault(c)
+		var req struct {
+			Chunks []string `json:"chunks"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		for _, h := range req.Chunks {
+			if !chunkHashRe.MatchString(h) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("bad chunk hash %q", h)})
+				return
+			}
+		}
+		v.mu.Lock()
+		pruneBlobs(cfg, v.root)
+		v.mu.Unlock()
+
+		ix := vaultChunkIndex(v.root)
+		v.mu.RLock()
+		err := ix.refresh(v.root)
+		v.mu.RUnlock()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		missing := []string{}
+		for _, h := range req.Chunks {
+			if _, ok := ix.locate(h); ok {
+				continue
+			}
+			if _, err := os.Stat(blobPath(v.root, h)); err == nil {
+				continue
+			}
+			missing = append(missing, h)
+		}
+		c.JSON(http.StatusOK, gin.H{"missing": missing})
+	}
+}
+
+// putChunksHandler принимает пачку кусков: zip, где имя записи — SHA‑256 её содержимого
+func putChunksHandler(cfg Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v := currentVault(c)
+		limit := int64(maxChunkBatch)
+		if cfg.MaxUploadBytes > 0 {
+			limit = cfg.MaxUploadBytes
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+
+		work, err := makeWorkDir(v.root, "chunks-*")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer os.RemoveAll(work)
+		tmpZip := filepath.Join(work, "chunks.zip")
+		out, err := os.Create(tmpZip)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		size, err := io.Copy(out, c.Request.Body)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			c.JSON(multipartErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		stored, err := storeChunks(v.root, tmpZip)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		setAuditStats(c, stored, size)
+		c.JSON(http.StatusOK, gin.H{"stored": stored})
+	}
+}
+
+// storeChunks раскладывает куски из архива по хранилищу блоков
+func storeChunks(root, zipPath string) (int, error) {
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	stored := 0
+	for _, f := range r.File {
+		if !chunkHashRe.MatchString(f.Name) {
+			return stored, fmt.Errorf("bad chunk name %q", f.Name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return stored, err
+		}
+		data, err := io.ReadAll(io.LimitReader(rc, cdcMax+1))
+		rc.Close()
+		if err != nil {
+			return stored, err
+		}
+		if len(data) > cdcMax {
+			return stored, fmt.Errorf("chunk %s is larger than %d bytes", f.Name, cdcMax)
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != f.Name {
+			return stored, fmt.Errorf("chunk %s checksum mismatch", f.Name)
+		}
+		if err := writeBlob(root, f.Name, data); err != nil {
+			return stored, err
+		}
+		stored++
+	}
+	return stored, nil
+}
+
+func writeBlob(root, hash string, data []byte) error {
+	path := blobPath(root, hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// chunkedFile — файл из коммита: путь, права, SHA‑256 и куски по порядку
+type chunkedFile struct {
+	Path   string      `json:"path"`
+	Size   int64       `json:"size"`
+	Mode   os.FileMode `json:"mode"`
+	SHA256 string      `json:"sha256"`
+	Chunks []chunkRef  `json:"chunks"`
+}
+
+// commitChunksHandler собирает файлы из кусков и применяет их вместе
+// с удалениями, как /delta: {"files": [...], "deleted": [...]}.
+// Если какого‑то куска нет, отвечает 409 со списком missing.
+func commitChunksHandler(cfg Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v := currentVault(c)
+		var req struct {
+			Files   []chunkedFile `json:"files"`
+			Deleted []string      `json:"deleted"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if len(req.Files) == 0 && len(req.Deleted) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "empty delta"})
+			return
+		}
+		base, ok := baseRevision(c, cfg)
+		if !ok || rejectStale(c, v, base) {
+			return
+		}
+
+		work, err := makeWorkDir(v.root, "chunks-*")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer os.RemoveAll(work)
+
+		ix := vaultChunkIndex(v.root)
+		v.mu.RLock()
+		blobs, received, code, err := assembleFiles(v.root, ix, filepath.Join(work, "staged"), req.Files)
+		v.mu.RUnlock()
+		if err != nil {
+			var missing missingChunksError
+			if errors.As(err, &missing) {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "missing": []string(missing)})
+				return
+			}
+			c.JSON(code, gin.H{"error": err.Error()})
+			return
+		}
+
+		changed, removed, rev, code, err := applyDeltaZip(cfg, v, work, "", req.Deleted, base)
+		if err != nil {
+			c.JSON(code, errorBody(c, err))
+			return
+		}
+
+		// Куски из блоков теперь лежат в файлах: запоминаем рецепты и убираем
+		// те блоки, что индекс находит в дереве. Параллельный коммит, которому
+		// /chunks/missing уже сказал, что кусок есть, прочитает его из файла,
+		// а если и файл успели поменять — получит 409 с missing и дошлёт кусок.
+		v.mu.RLock()
+		err = ix.learn(v.root, req.Files)
+		if err != nil {
+			log.Printf("chunk index: %v", err)
+		} else {
+			for _, h := range blobs {
+				if _, ok := ix.locate(h); ok {
+					_ = os.Remove(blobPath(v.root, h))
+				}
+			}
+		}
+		v.mu.RUnlock()
+
+		setAuditStats(c, changed+removed, received)
+		setRevision(c, rev)
+		c.JSON(http.StatusOK, gin.H{"status": "delta applied", "changed": changed, "deleted": removed, "revision": rev})
+	}
+}
+
+// missingChunksError — коммит ссылается на куски, которых у сервера нет
+type missingChunksError []string
+
+func (e missingChunksError) Error() string {
+	return fmt.Sprintf("%d chunks missing", len(e))
+}
+
+// assembleFiles собирает файлы коммита в staged. Возвращает использованные
+// блоки и их объём. Вызывающий должен держать блокировку vault на чтение.
+func assembleFiles(root string, ix *chunkIndex, staged string, files []chunkedFile) (blobs []string, received int64, code int, err error) {
+	if err := ix.refresh(root); err != nil {
+		return nil, 0, http.StatusInternalServerError, err
+	}
+	var missing missingChunksError
+	for _, f := range files {
+		for _, ch := range f.Chunks {
+			if _, ok := ix.locate(ch.Hash); ok {
+				continue
+			}
+			if _, err := os.Stat(blobPath(root, ch.Hash)); err != nil {
+				missing = append(missing, ch.Hash)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return nil, 0, http.StatusConflict, missing
+	}
+
+	usedBlobs := make(map[string]struct{})
+	for _, f := range files {
+		dst, err := resolveInRoot(staged, f.Path)
+		if err != nil {
+			return nil, 0, http.StatusBadRequest, err
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return nil, 0, http.StatusInternalServerError, err
+		}
+		mode := f.Mode.Perm()
+		if mode == 0 {
+			mode = 0644
+		}
+		out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+		if err != nil {
+			return nil, 0, http.StatusBadRequest, fmt.Errorf("%s: %w", f.Path, err) // путь повторяется в коммите
+		}
+		h := sha256.New()
+		var size int64
+		for _, ch := range f.Chunks {
+			data, fromBlob, rerr := readChunk(root, ix, ch)
+			if errors.Is(rerr, errChunkMissing) {
+				// Блок пропал уже после проверки выше — клиенту надо его дослать
+				err = missingChunksError{ch.Hash}
+				break
+			}
+			if rerr != nil {
+				err = rerr
+				break
+			}
+			if fromBlob {
+				if _, ok := usedBlobs[ch.Hash]; !ok {
+					usedBlobs[ch.Hash] = struct{}{}
+					received += ch.Size
+				}
+			}
+			h.Write(data)
+			size += int64(len(data))
+			if _, err = out.Write(data); err != nil {
+				break
+			}
+		}
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if errors.As(err, &missing) {
+			return nil, 0, http.StatusConflict, missing
+		}
+		if err != nil {
+			return nil, 0, http.StatusInternalServerError, fmt.Errorf("%s: %w", f.Path, err)
+		}
+		if size != f.Size || hex.EncodeToString(h.Sum(nil)) != f.SHA256 {
+			return nil, 0, http.StatusBadRequest, fmt.Errorf("%s: assembled file does not match its sha256", f.Path)
+		}
+	}
+	for hash := range usedBlobs {
+		blobs = append(blobs, hash)
+	}
+	return blobs, received, http.StatusOK, nil
+}
+
+// preserveChunks переносит в хранилище блоков куски файлов, которые сейчас
+// уйдут из дерева (outgoing по относительному пути), если на них ссылается
+// какой‑нибудь снапшот и больше их взять будет неоткуда: ни в остающихся
+// файлах, ни среди новых (staged). Вызывается перед записью под блокировкой
+// vault на запись; ошибка отменяет запись, иначе история потеряла бы данные.
+func preserveChunks(root string, outgoing func(rel string) bool, staged string) error {
+	refs, err := blockRefs(root)
+	if err != nil || len(refs) == 0 {
+		return err
+	}
+	ix := vaultChunkIndex(root)
+	if err := ix.refresh(root); err != nil {
+		return err
+	}
+	keep := make(map[string]struct{})
+	leaving := make(map[string]fileRecipe)
+	for rel, r := range ix.recipes() {
+		if outgoing(rel) {
+			leaving[rel] = r
+			continue
+		}
+		for _, ch := range r.Chunks {
+			keep[ch.Hash] = struct{}{}
+		}
+	}
+	if len(leaving) == 0 {
+		return nil
+	}
+	if err := treeChunks(staged, keep); err != nil {
+		return err
+	}
+
+	for rel, r := range leaving {
+		if err := preserveFile(root, rel, r, refs, keep); err != nil {
+			return fmt.Errorf("%s: %w", rel, err)
+		}
+	}
+	return nil
+}
+
+// preserveFile пишет в блоки нужные снапшотам куски одного файла дерева
+func preserveFile(root, rel string, r fileRecipe, refs map[string]int, keep map[string]struct{}) error {
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	var off int64
+	for _, ch := range r.Chunks {
+		off += ch.Size
+		if _, ok := keep[ch.Hash]; ok || refs[ch.Hash] == 0 {
+			continue
+		}
+		keep[ch.Hash] = struct{}{} // второй раз тот же кусок не пишем
+		if _, err := os.Stat(blobPath(root, ch.Hash)); err == nil {
+			continue
+		}
+		if f == nil {
+			var err error
+			if f, err = os.Open(filepath.Join(root, filepath.FromSlash(rel))); err != nil {
+				return err
+			}
+		}
+		data := make([]byte, ch.Size)
+		if _, err := f.ReadAt(data, off-ch.Size); err != nil {
+			return err
+		}
+		if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != ch.Hash {
+			// Файл подменили в обход сервера: кусок уже потерян, но запись
+			// из‑за этого блокировать нельзя
+			log.Printf("preserve %s: chunk %s changed on disk", rel, ch.Hash)
+			continue
+		}
+		if err := writeBlob(root, ch.Hash, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// treeChunks добавляет в set куски всех файлов под dir
+func treeChunks(dir string, set map[string]struct{}) error {
+	if dir == "" {
+		return nil
+	}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		chunks, err := chunkFile(path)
+		for _, ch := range chunks {
+			set[ch.Hash] = struct{}{}
+		}
+		return err
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil // дельта из одних удалений
+	}
+	return err
+}
+
+// pruneBlobs удаляет блоки, на которые не ссылается ни один снапшот и которые
+// не попали в коммит за UploadSessionTTL. Вызывающий держит блокировку vault
+// на запись: иначе блок, нужный только что созданному снапшоту, можно удалить.
+func pruneBlobs(cfg Config, root string) {
+	if cfg.UploadSessionTTL <= 0 {
+		return
+	}
+	refs, err := blockRefs(root)
+	if err != nil {
+		log.Printf("prune blocks: %v", err)
+		return
+	}
+	_ = filepath.WalkDir(blocksRoot(root), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || refs[d.Name()] > 0 {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && time.Since(info.ModTime()) > cfg.UploadSessionTTL {
+			_ = os.Remove(path)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Служебный каталог внутри storage: staging, бэкапы и прочее.
+// Не попадает ни в манифест, ни в /download, не заменяется при /upload.
+const internalDir = ".syncerch"
+
+// deltaHandler принимает частичное обновление: zip только с изменёнными файлами
+// (поле "files", может отсутствовать) и JSON‑список удалённых путей (поле "deleted").
+// Изменения применяются целиком или не применяются вовсе.
+func deltaHandler(cfg Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v := currentVault(c)
+		base, ok := baseRevision(c, cfg)
+		if !ok || rejectStale(c, v, base) {
+			return
+		}
+		if cfg.MaxUploadBytes > 0 {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, cfg.MaxUploadBytes)
+		}
+
+		work, err := makeWorkDir(v.root, "delta-*")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer os.RemoveAll(work)
+
+		tmpZip := filepath.Join(work, "delta.zip")
+		fields, size, err := receiveMultipart(c, "files", tmpZip)
+		if err != nil {
+			c.JSON(multipartErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		if size < 0 {
+			tmpZip, size = "", 0
+		}
+		var deleted []string
+		if raw := fields["deleted"]; raw != "" {
+			if err := json.Unmarshal([]byte(raw), &deleted); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid deleted list: " + err.Error()})
+				return
+			}
+		}
+		if tmpZip == "" && len(deleted) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "empty delta"})
+			return
+		}
+
+		changed, removed, rev, code, err := applyDeltaZip(cfg, v, work, tmpZip, deleted, base)
+		if err != nil {
+			c.JSON(code, errorBody(c, err))
+			return
+		}
+		setAuditStats(c, changed+removed, size)
+		setRevision(c, rev)
+		c.JSON(http.StatusOK, gin.H{"status": "delta applied", "changed": changed, "deleted": removed, "revision": rev})
+	}
+}
+
+// applyDeltaZip применяет к vault файлы из архива zipPath и удаления deleted.
+// Без архива применяется то, что уже разложено в work/staged (или только удаления).
+// Как и replaceFromZip, проверяет ревизию base и возвращает новую ревизию
+// и HTTP‑статус ошибки.
+func applyDeltaZip(cfg Config, v *vault, work, zipPath string, deleted []string, base int64) (changed, removed int, rev int64, code int, err error) {
+	staged := filepath.Join(work, "staged")
+	if zipPath != "" {
+		if _, err := safeUnzip(zipPath, staged); err != nil {
+			return 0, 0, 0, http.StatusBadRequest, err
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if err := v.checkRevision(base); err != nil {
+		return 0, 0, 0, http.StatusConflict, err
+	}
+	if snapshotDue(cfg, v.root) {
+		if _, err := takeSnapshot(cfg, v.root, "delta"); err != nil {
+			return 0, 0, 0, http.StatusInternalServerError, fmt.Errorf("snapshot failed: %w", err)
+		}
+	}
+	if err := preserveChunks(v.root, deltaOutgoing(staged, deleted), staged); err != nil {
+		return 0, 0, 0, http.StatusInternalServerError, fmt.Errorf("snapshot failed: %w", err)
+	}
+	changedPaths, removedPaths, err := applyDelta(v.root, staged, deleted, filepath.Join(work, "backup"))
+	if err != nil {
+		return 0, 0, 0, http.StatusInternalServerError, err
+	}
+	rev = v.commitRevision("delta", append(changedPaths, removedPaths...), true)
+	return len(changedPaths), len(removedPaths), rev, http.StatusOK, nil
+}
+
+// deltaOutgoing — какие файлы дерева дельта заменит или удалит
+func deltaOutgoing(staged string, deleted []string) func(rel string) bool {
+	gone := make(map[string]struct{}, len(deleted))
+	for _, rel := range deleted {
+		gone[path.Clean(strings.TrimLeft(strings.ReplaceAll(rel, "\\", "/"), "/"))] = struct{}{}
+	}
+	return func(rel string) bool {
+		if _, ok := gone[rel]; ok {
+			return true
+		}
+		_, err := os.Lstat(filepath.Join(staged, filepath.FromSlash(rel)))
+		return err == nil
+	}
+}
+
+// makeWorkDir создаёт временный каталог в служебной папке storage.
+// Он на той же ФС, что и данные, поэтому os.Rename оттуда атомарен.
+func makeWorkDir(root, pattern string) (string, error) {
+	base := filepath.Join(root, internalDir)
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(base, pattern)
+}
+
+// resolveInRoot превращает относительный путь от клиента в путь внутри root.
+// Отклоняет выход за пределы root и обращения к служебному каталогу.
+func resolveInRoot(root, rel string) (string, error) {
+	name := strings.ReplaceAll(rel, "\\", "/")
+	name = strings.TrimLeft(name, "/")
+	name = filepath.Clean(filepath.FromSlash(name))
+	if name == "." || name == ".." || strings.HasPrefix(name, ".."+string(os.PathSeparator)) {
+		return "", fmt.Errorf("invalid path %q", rel)
+	}
+	if isInternalPath(name) {
+		return "", fmt.Errorf("path %q is reserved", rel)
+	}
+	return filepath.Join(filepath.Clean(root), name), nil
+}
+
+// isInternalPath — относится ли относительный путь к служебному каталогу
+func isInternalPath(rel string) bool {
+	first := strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+	return first == internalDir
+}
+
+type deltaMove struct {
+	from, to string
+}
+
+// applyDelta удаляет deleted, переносит файлы из staged в root и возвращает
+// затронутые пути (с прямыми слэшами). Всё, что перезаписывается или удаляется, сначала уезжает в backup;
+// при любой ошибке сделанные шаги откатываются в обратном порядке.
+func applyDelta(root, staged string, deleted []string, backup string) (changed, removed []string, err error) {
+	var done []deltaMove
+	move := func(from, to string) error {
+		if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(from, to); err != nil {
+			return err
+		}
+		done = append(done, deltaMove{from: from, to: to})
+		return nil
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(done) - 1; i >= 0; i-- {
+			_ = os.MkdirAll(filepath.Dir(done[i].from), 0755)
+			if rerr := os.Rename(done[i].to, done[i].from); rerr != nil {
+				log.Printf("delta rollback: %v", rerr)
+			}
+		}
+	}()
+
+	var files []string
+	if _, statErr := os.Stat(staged); statErr == nil {
+		err = filepath.WalkDir(staged, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Сначала пути назначения: файл, который приходит в этой же дельте,
+	// не удаляется — новая версия важнее
+	type stagedFile struct{ src, dst, rel string }
+	incoming := make([]stagedFile, 0, len(files))
+	seen := make(map[string]struct{}, len(files))
+	for _, src := range files {
+		rel, rerr := filepath.Rel(staged, src)
+		if rerr != nil {
+			return nil, nil, rerr
+		}
+		dst, rerr := resolveInRoot(root, rel)
+		if rerr != nil {
+			return nil, nil, rerr
+		}
+		incoming = append(incoming, stagedFile{src: src, dst: dst, rel: rel})
+		seen[dst] = struct{}{}
+	}
+
+	// Удаления идут первыми: каталог a/ с удалённым a/x может в этой же
+	// дельте стать файлом a, а файл a — каталогом a/
+	for _, rel := range deleted {
+		dst, rerr := resolveInRoot(root, rel)
+		if rerr != nil {
+			return nil, nil, rerr
+		}
+		if _, ok := seen[dst]; ok {
+			continue
+		}
+		fi, serr := os.Lstat(dst)
+		if errors.Is(serr, fs.ErrNotExist) {
+			continue // уже удалён — не ошибка
+		}
+		if serr != nil {
+			return nil, nil, serr
+		}
+		if fi.IsDir() {
+			return nil, nil, fmt.Errorf("cannot delete directory %q", rel)
+		}
+		clean, rerr := filepath.Rel(filepath.Clean(root), dst)
+		if rerr != nil {
+			return nil, nil, rerr
+		}
+		if err = move(dst, filepath.Join(backup, "deleted", clean)); err != nil {
+			return nil, nil, err
+		}
+		removeEmptyParents(root, filepath.Dir(dst))
+		removed = append(removed, filepath.ToSlash(clean))
+	}
+
+	for _, f := range incoming {
+		if fi, serr := os.Lstat(f.dst); serr == nil {
+			if fi.IsDir() {
+				return nil, nil, fmt.Errorf("cannot replace directory %q with a file", f.rel)
+			}
+			if err = move(f.dst, filepath.Join(backup, "changed", f.rel)); err != nil {
+				return nil, nil, err
+			}
+		}
+		if err = move(f.src, f.dst); err != nil {
+			return nil, nil, err
+		}
+		changed = append(changed, filepath.ToSlash(f.rel))
+	}
+	return changed, removed, nil
+}
+
+// removeEmptyParents удаляет опустевшие каталоги вверх до root (не включая)
+func removeEmptyParents(root, dir string) {
+	root = filepath.Clean(root)
+	for dir = filepath.Clean(dir); dir != root && strings.HasPrefix(dir, root+string(os.PathSeparator)); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+	}
+}
+
+// fileHandler отдаёт один файл хранилища — для дельта‑скачивания на клиенте
+func fileHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v := currentVault(c)
+		path, err := resolveInRoot(v.root, c.Param("path"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		v.mu.RLock()
+		defer v.mu.RUnlock()
+
+		f, err := os.Open(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !info.Mode().IsRegular() {
+			c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+			return
+		}
+
+		c.Header("Content-Type", "application/octet-stream")
+		c.Header("Cache-Control", "no-store")
+		http.ServeContent(c.Writer, c.Request, "", info.ModTime(), f)
+	}
+}
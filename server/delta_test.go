@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// writeTree раскладывает файлы path → содержимое; путь с "/" на конце — пустой каталог
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for rel, data := range files {
+		p := filepath.Join(root, filepath.FromSlash(rel))
+		if rel[len(rel)-1] == '/' {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTree — обратное к writeTree: файлы и пустые каталоги под root
+func readTree(t *testing.T, root string) map[string]string {
+	t.Helper()
+	out := map[string]string{}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == root {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if entries, _ := os.ReadDir(p); len(entries) == 0 {
+				out[rel+"/"] = ""
+			}
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		out[rel] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestApplyDelta(t *testing.T) {
+	tests := []struct {
+		name    string
+		before  map[string]string
+		staged  map[string]string
+		deleted []string
+		after   map[string]string // nil — ошибка, дерево не меняется
+		changed []string
+		removed []string
+	}{
+		{
+			name:    "add and replace",
+			before:  map[string]string{"a.md": "old", "b.md": "b"},
+			staged:  map[string]string{"a.md": "new", "dir/c.md": "c"},
+			after:   map[string]string{"a.md": "new", "b.md": "b", "dir/c.md": "c"},
+			changed: []string{"a.md", "dir/c.md"},
+		},
+		{
+			name:    "delete prunes empty directories",
+			before:  map[string]string{"a/b/c.md": "c", "d.md": "d"},
+			deleted: []string{"a/b/c.md", "missing.md"},
+			after:   map[string]string{"d.md": "d"},
+			removed: []string{"a/b/c.md"},
+		},
+		{
+			name:    "staged file wins over deletion",
+			before:  map[string]string{"a.md": "old"},
+			staged:  map[string]string{"a.md": "new"},
+			deleted: []string{"a.md"},
+			after:   map[string]string{"a.md": "new"},
+			changed: []string{"a.md"},
+		},
+		{
+			name:    "directory becomes a file",
+			before:  map[string]string{"a/x.md": "x"},
+			staged:  map[string]string{"a": "file"},
+			deleted: []string{"a/x.md"},
+			after:   map[string]string{"a": "file"},
+			changed: []string{"a"},
+			removed: []string{"a/x.md"},
+		},
+		{
+			name:    "file becomes a directory",
+			before:  map[string]string{"a": "file"},
+			staged:  map[string]string{"a/x.md": "x"},
+			deleted: []string{"a"},
+			after:   map[string]string{"a/x.md": "x"},
+			changed: []string{"a/x.md"},
+			removed: []string{"a"},
+		},
+		{
+			name:    "rollback when a directory is not emptied",
+			before:  map[string]string{"a/x.md": "x", "a/y.md": "y", "b.md": "old"},
+			staged:  map[string]string{"b.md": "new", "a": "file"},
+			deleted: []string{"a/x.md"},
+		},
+		{
+			name:    "rollback on a directory in deleted",
+			before:  map[string]string{"a.md": "old", "dir/x.md": "x"},
+			staged:  map[string]string{"a.md": "new"},
+			deleted: []string{"dir"},
+		},
+		{
+			name:    "rollback on a path outside root",
+			before:  map[string]string{"a.md": "a", "b.md": "b"},
+			deleted: []string{"a.md", "../b.md"},
+		},
+		{
+			name:   "reserved path",
+			before: map[string]string{"a.md": "a"},
+			staged: map[string]string{internalDir + "/x": "x"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			root, staged, backup := filepath.Join(dir, "root"), filepath.Join(dir, "staged"), filepath.Join(dir, "backup")
+			writeTree(t, root, tt.before)
+			writeTree(t, staged, tt.staged)
+
+			changed, removed, err := applyDelta(root, staged, tt.deleted, backup)
+			if tt.after == nil {
+				if err == nil {
+					t.Fatal("no error")
+				}
+				if got := readTree(t, root); !maps.Equal(got, tt.before) {
+					t.Fatalf("tree not rolled back: %v, want %v", got, tt.before)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readTree(t, root); !maps.Equal(got, tt.after) {
+				t.Errorf("tree = %v, want %v", got, tt.after)
+			}
+			slices.Sort(changed)
+			if !slices.Equal(changed, tt.changed) {
+				t.Errorf("changed = %v, want %v", changed, tt.changed)
+			}
+			if !slices.Equal(removed, tt.removed) {
+				t.Errorf("removed = %v, want %v", removed, tt.removed)
+			}
+		})
+	}
+}
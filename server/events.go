@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Ревизия vault — счётчик, который растёт на каждой записи (upload, delta,
+// коммиты докачиваемых загрузок и кусков, restore). Хранится в
+// .syncerch/revision, чтобы переживать перезапуск. Каждое увеличение
+// рассылается подписчикам GET /events (Server‑Sent Events) вместе со списком
+// изменённых путей — клиенту не нужно опрашивать сервер, чтобы узнать о
+// чужой правке.
+const (
+	revisionFile = "revision"
+
+	eventHistory  = 64               // сколько последних событий помнить для Last-Event-ID
+	eventBuffer   = 16               // очередь одного подписчика, переполнилась — отключаем его
+	maxEventPaths = 1000             // больше — событие уходит без путей, с truncated
+	eventsPing    = 25 * time.Second // комментарий‑пинг, чтобы прокси не рвали тихое соединение
+	eventsRetry   = 5000             // мс, через сколько EventSource переподключается
+)
+
+// revisionEvent — одно событие потока /events
+type revisionEvent struct {
+	Vault     string    `json:"vault"`
+	Revision  int64     `json:"revision"`
+	Action    string    `json:"action,omitempty"` // upload, delta, restore; пусто — текущее состояние при подключении
+	Paths     []string  `json:"paths"`
+	Truncated bool      `json:"truncated,omitempty"` // список путей неизвестен или слишком длинный — сверьте манифест
+	Time      time.Time `json:"time"`
+}
+
+// eventHub — ревизия vault и подписчики на её изменения
+type eventHub struct {
+	mu      sync.Mutex
+	rev     int64
+	history []revisionEvent
+	subs    map[chan revisionEvent]struct{}
+}
+
+// shuttingDown закрывается при остановке сервера: открытые потоки /events
+// иначе держали бы srv.Shutdown до таймаута
+var shuttingDown = make(chan struct{})
+
+// loadRevision читает сохранённую ревизию vault, её нет — 0
+func loadRevision(root string) int64 {
+	data, err := os.ReadFile(filepath.Join(root, internalDir, revisionFile))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("revision %s: %v", root, err)
+		}
+		return 0
+	}
+	rev, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		log.Printf("revision %s: %v", root, err)
+		return 0
+	}
+	return rev
+}
+
+func writeRevision(root string, rev int64) error {
+	dir := filepath.Join(root, internalDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, revisionFile)
+	if err := os.WriteFile(path+".tmp", []byte(strconv.FormatInt(rev, 10)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// commitRevision увеличивает ревизию после записи и оповещает подписчиков.
+// paths — изменённые и удалённые пути; complete = false, если список
+// неизвестен. Вызывающий должен держать v.mu на запись.
+func (v *vault) commitRevision(action string, paths []string, complete bool) int64 {
+	h := &v.events
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rev++
+
+	if err := writeRevision(v.root, h.rev); err != nil {
+		// Дерево уже изменено, откатывать поздно; после перезапуска ревизия
+		// окажется меньше, и клиенты просто синхронизируются заново
+		log.Printf("revision %s: %v", v.root, err)
+	}
+
+	ev := revisionEvent{Vault: v.name, Revision: h.rev, Action: action, Paths: paths, Time: time.Now().UTC()}
+	if !complete || len(paths) > maxEventPaths {
+		ev.Paths, ev.Truncated = []string{}, true
+	}
+	if ev.Paths == nil {
+		ev.Paths = []string{}
+	}
+	h.history = append(h.history, ev)
+	if len(h.history) > eventHistory {
+		h.history = h.history[len(h.history)-eventHistory:]
+	}
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+			// Не успевает читать: отключаем, переподключится с Last-Event-ID
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+	return h.rev
+}
+
+// subscribe подписывает на события vault. after — последняя ревизия, которую
+// клиент уже видел (Last-Event-ID), -1 — не видел ничего. backlog — что
+// отправить сразу: пропущенные события из истории или, если их уже нет
+// (или клиент подключился впервые), одно событие с текущей ревизией.
+func (h *eventHub) subscribe(name string, after int64) (ch chan revisionEvent, backlog []revisionEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs == nil {
+		h.subs = make(map[chan revisionEvent]struct{})
+	}
+	ch = make(chan revisionEvent, eventBuffer)
+	h.subs[ch] = struct{}{}
+
+	if after == h.rev {
+		return ch, nil
+	}
+	if after >= 0 && after < h.rev {
+		for i, ev := range h.history {
+			if ev.Revision == after+1 {
+				return ch, append([]revisionEvent(nil), h.history[i:]...)
+			}
+		}
+	}
+	current := revisionEvent{Vault: name, Revision: h.rev, Paths: []string{}, Time: time.Now().UTC()}
+	// Клиент что‑то пропустил, а подробностей уже нет
+	current.Truncated = after >= 0
+	return ch, []revisionEvent{current}
+}
+
+func (h *eventHub) unsubscribe(ch chan revisionEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// eventsHandler — GET /events, поток Server‑Sent Events:
+//
+//	id: 42
+//	event: revision
+//	data: {"vault":"default","revision":42,"action":"delta","paths":["notes/a.md"],...}
+//
+// При подключении сразу приходит текущая ревизия (или пропущенные события,
+// если передан Last-Event-ID либо ?since=).
+func eventsHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v := currentVault(c)
+		after := int64(-1)
+		since := c.GetHeader("Last-Event-ID")
+		if since == "" {
+			since = c.Query("since")
+		}
+		if since != "" {
+			n, err := strconv.ParseInt(since, 10, 64)
+			if err != nil || n < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid Last-Event-ID"})
+				return
+			}
+			after = n
+		}
+
+		ch, backlog := v.events.subscribe(v.name, after)
+		defer v.events.unsubscribe(ch)
+		metricEventStreams.add(1)
+		defer metricEventStreams.add(-1)
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-store")
+		c.Header("X-Accel-Buffering", "no") // nginx не должен копить поток
+		c.Status(http.StatusOK)
+		w := c.Writer
+		fmt.Fprintf(w, "retry: %d\n\n", eventsRetry)
+		for _, ev := range backlog {
+			if err := writeEvent(w, ev); err != nil {
+				return
+			}
+		}
+		w.Flush()
+
+		ping := time.NewTicker(eventsPing)
+		defer ping.Stop()
+		for {
+			select {
+			case <-c.Request.Context().Done():
+				return
+			case <-shuttingDown:
+				return
+			case ev, ok := <-ch:
+				if !ok {
+					return
+				}
+				if err := writeEvent(w, ev); err != nil {
+					return
+				}
+			case <-ping.C:
+				if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+					return
+				}
+			}
+			w.Flush()
+		}
+	}
+}
+
+func writeEvent(w gin.ResponseWriter, ev revisionEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: revision\ndata: %s\n\n", ev.Revision, data)
+	return err
+}
+
+// manifestDiff перечисляет пути, которые появились, изменились или исчезли
+func manifestDiff(before, after Manifest) []string {
+	old := make(map[string]string, len(before.Files))
+	for _, f := range before.Files {
+		old[f.Path] = f.SHA256
+	}
+	var paths []string
+	for _, f := range after.Files {
+		if sum, ok := old[f.Path]; !ok || sum != f.SHA256 {
+			paths = append(paths, f.Path)
+		}
+		delete(old, f.Path)
+	}
+	for p := range old {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// treeChanges перечисляет пути, которые поменяет замена дерева root деревом
+// с манифестом after. Нужна там, где дерево подменяется целиком (upload,
+// restore): after известен до подмены, а хэши root обычно уже в кэше, так что
+// под блокировкой остаётся один обход каталогов. Вызывающий должен держать v.mu.
+func treeChanges(root string, after Manifest) ([]string, bool) {
+	before, err := buildManifest(root)
+	if err != nil {
+		return nil, false
+	}
+	return manifestDiff(before, after), true
+}
@@ -6,13 +6,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
@@ -20,22 +21,46 @@ import (
 )
 
 type Config struct {
-	StoragePath        string
-	TokenFile          string
-	Port               string
-	MaxMultipartMemory int64 // bytes
-	MaxUploadBytes     int64 // bytes (лимит всего запроса), 0 = без лимита
+	StoragePath          string
+	TokenFile            string
+	Port                 string
+	MaxMultipartMemory   int64         // bytes; загрузки архивов читаются потоком и его не используют
+	MaxUploadBytes       int64         // bytes (лимит всего запроса), 0 = без лимита
+	SnapshotKeep         int           // сколько прошлых версий хранить, 0 = снапшоты выключены
+	SnapshotMaxAge       time.Duration // удалять снапшоты старше, 0 = без ограничения
+	SnapshotInterval     time.Duration // снапшот перед дельтой не чаще, 0 = перед каждой
+	VaultsPath           string        // где лежат именованные vault'ы
+	TokenPepper          string        // секрет для хэшей токенов, см. hashToken
+	TokenFallback        bool          // принимать токен из ?token= и cookie (только GET)
+	AuditLog             string        // файл журнала аудита, "off" — не вести
+	AuditMaxBytes        int64         // размер, после которого журнал ротируется
+	MetricsPublic        bool          // отдавать /metrics без токена
+	TrustedProxies       []string      // от кого принимать X-Forwarded-For, пусто — ни от кого
+	RateLimitRPS         float64       // запросов в секунду с одного IP, 0 = без лимита
+	RateLimitBurst       int           // сколько запросов с IP можно сделать разом
+	GlobalRateLimitRPS   float64       // запросов в секунду всего, 0 = без лимита
+	GlobalRateLimitBurst int           // то же для общего лимита
+	AuthMaxFailures      int           // неудачных попыток до бана, 0 = не банить
+	AuthFailWindow       time.Duration // за какое время считаются неудачи
+	AuthBanBase          time.Duration // первый бан, дальше каждый вдвое длиннее
+	AuthBanMax           time.Duration // потолок длины бана
+	TLSCert              string        // PEM сертификата; вместе с TLSKey включает HTTPS
+	TLSKey               string
+	TLSClientCA          string        // CA клиентских сертификатов, включает mTLS
+	UploadSessionTTL     time.Duration // сколько хранить брошенную докачиваемую загрузку
+	ArchiveCache         bool          // собирать /download в файл и отдавать с Range, без этого докачки нет (место — ещё один vault)
+	RequireIfMatch       bool          // запись только с If-Match: <ревизия>, см. revision.go
 }
 
-var (
-	tokens     = make(map[string]struct{})
-	tokensLock sync.RWMutex
-
-	storeLock sync.RWMutex // защищает операции чтения/записи каталога storage
-)
-
 func main() {
 	cfg := loadConfig()
+	tokenPepper = cfg.TokenPepper
+
+	// Подкоманда server token ... вместо запуска сервера; прочие аргументы,
+	// как и раньше, игнорируются
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		os.Exit(runCommand(cfg, os.Args[1:], os.Stdout, os.Stderr))
+	}
 
 	if err := os.MkdirAll(cfg.StoragePath, 0755); err != nil {
 		log.Fatalf("failed to create storage dir %s: %v", cfg.StoragePath, err)
@@ -47,12 +72,24 @@ func main() {
 	defer stop()
 	go watchTokens(ctx, cfg.TokenFile, 5*time.Second)
 
+	if err := openAuditLog(cfg.AuditLog, cfg.AuditMaxBytes); err != nil {
+		log.Fatalf("failed to open audit log %s: %v", cfg.AuditLog, err)
+	}
+	defer closeAuditLog()
+
 	// Gin в release‑режиме по умолчанию
 	if gin.Mode() == gin.DebugMode && os.Getenv("GIN_MODE") == "" {
 		gin.SetMode(gin.ReleaseMode)
 	}
 	r := gin.New()
-	r.Use(gin.Logger(), gin.Recovery())
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("invalid TRUSTED_PROXIES: %v", err)
+	}
+	r.Use(gin.Logger(), gin.Recovery(), metricsMiddleware())
+
+	lim := newLimiter(cfg)
+	go lim.cleanup(ctx, time.Minute)
+	log.Printf("limits: %s", lim)
 
 	// Ограничение памяти multipart (чтобы не держать файл в RAM)
 	r.MaxMultipartMemory = cfg.MaxMultipartMemory
@@ -66,148 +103,279 @@ func main() {
 		}
 		c.JSON(http.StatusOK, gin.H{"status": "ready"})
 	})
+	// Метрики — без токена, только если так настроено; иначе нужен токен с
+	// правом a: в них объём и число файлов всех vault'ов, а токен с
+	// ограничением по vault'ам не должен видеть чужие
+	if cfg.MetricsPublic {
+		r.GET("/metrics", metricsHandler(cfg, lim))
+	}
 
-	// Авторизация на остальные пути
-	r.Use(authMiddleware())
+	// Лимиты и авторизация на остальные пути
+	r.Use(lim.middleware(), authMiddleware(cfg, lim))
 
-	r.POST("/upload", func(c *gin.Context) {
-		// Лимит на общий объём запроса (включая заголовки/части multipart)
-		if cfg.MaxUploadBytes > 0 {
-			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, cfg.MaxUploadBytes)
-		}
+	if !cfg.MetricsPublic {
+		r.GET("/metrics", requirePerm(permAdmin), metricsHandler(cfg, lim))
+	}
+	r.GET("/vaults", vaultsHandler(cfg))
+	r.GET("/audit", auditAction("audit"), requirePerm(permAdmin), auditHandler())
+	// Старые пути работают с vault "default", остальные — /vaults/<имя>/...
+	registerVaultRoutes(r.Group("/", vaultMiddleware(cfg)), cfg)
+	registerVaultRoutes(r.Group("/vaults/:vault", vaultMiddleware(cfg)), cfg)
 
-		file, err := c.FormFile("folder")
+	srv := &http.Server{
+		Addr:    ":" + cfg.Port,
+		Handler: r,
+	}
+	srv.RegisterOnShutdown(func() { close(shuttingDown) })
+
+	useTLS := cfg.TLSCert != "" || cfg.TLSKey != ""
+	if useTLS {
+		certs, err := newCertReloader(cfg)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "no file uploaded"})
-			return
+			log.Fatalf("tls: %v", err)
 		}
+		go certs.watch(ctx, 5*time.Second)
+		srv.TLSConfig = certs.tlsConfig()
+	}
 
-		storeLock.Lock()
-		defer storeLock.Unlock()
+	go func() {
+		log.Printf("listening on :%s (tls=%t, mtls=%t), storage=%s, tokens=%s",
+			cfg.Port, useTLS, cfg.TLSClientCA != "", cfg.StoragePath, cfg.TokenFile)
+		var err error
+		if useTLS {
+			err = srv.ListenAndServeTLS("", "") // сертификат берётся из TLSConfig
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("listen: %v", err)
+		}
+	}()
 
-		// Чистим storage (безопасность: не позволяем удалить /)
-		if err := safeCleanDir(cfg.StoragePath); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	<-ctx.Done()
+	log.Println("shutting down...")
+	shutCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutCtx); err != nil {
+		log.Printf("server shutdown error: %v", err)
+	}
+	log.Println("bye")
+}
+
+// registerVaultRoutes вешает на группу все операции с одним vault
+func registerVaultRoutes(g *gin.RouterGroup, cfg Config) {
+	read, write := requirePerm(permRead), requirePerm(permWrite)
+	mkdir := ensureVaultDir() // каталог vault заводит только запись
+	g.POST("/upload", auditAction("upload"), write, mkdir, uploadHandler(cfg))
+	g.GET("/download", auditAction("download"), read, downloadHandler(cfg))
+	g.GET("/manifest", read, manifestHandler())
+	g.GET("/events", read, eventsHandler())
+	g.POST("/delta", auditAction("delta"), write, mkdir, deltaHandler(cfg))
+	g.POST("/uploads", write, mkdir, createUploadHandler(cfg))
+	g.GET("/uploads/:id", write, mkdir, uploadStatusHandler())
+	g.PUT("/uploads/:id/chunks/:n", write, mkdir, uploadChunkHandler())
+	g.POST("/uploads/:id/commit", auditAction("commit"), write, mkdir, commitUploadHandler(cfg))
+	g.DELETE("/uploads/:id", write, mkdir, abortUploadHandler())
+	g.POST("/chunks/missing", write, mkdir, missingChunksHandler(cfg))
+	g.POST("/chunks", auditAction("chunks"), write, mkdir, putChunksHandler(cfg))
+	g.POST("/chunks/commit", auditAction("commit"), write, mkdir, commitChunksHandler(cfg))
+	g.GET("/files/*path", read, fileHandler())
+	g.GET("/snapshots", read, snapshotsHandler())
+	g.POST("/snapshots/:id/restore", auditAction("restore"), write, mkdir, restoreHandler(cfg))
+}
+
+func uploadHandler(cfg Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v := currentVault(c)
+
+		base, ok := baseRevision(c, cfg)
+		if !ok || rejectStale(c, v, base) {
 			return
 		}
-		if err := os.MkdirAll(cfg.StoragePath, 0755); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+
+		// Лимит на общий объём запроса (включая заголовки/части multipart)
+		if cfg.MaxUploadBytes > 0 {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, cfg.MaxUploadBytes)
 		}
 
-		// Временный файл рядом со storage
-		tmpFile, err := os.CreateTemp(cfg.StoragePath, "upload-*.zip")
+		// Распаковываем во временный каталог рядом с данными, не трогая storage:
+		// битый архив или нехватка места не должны оставить его пустым
+		work, err := makeWorkDir(v.root, "upload-*")
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		tmpPath := tmpFile.Name()
-		tmpFile.Close()
-		defer os.Remove(tmpPath)
+		defer os.RemoveAll(work)
 
-		if err := c.SaveUploadedFile(file, tmpPath); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		tmpPath := filepath.Join(work, "upload.zip")
+		_, size, err := receiveMultipart(c, "folder", tmpPath)
+		if err != nil {
+			c.JSON(multipartErrorStatus(err), gin.H{"error": err.Error()})
 			return
 		}
-
-		if err := safeUnzip(tmpPath, cfg.StoragePath); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if size < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "no file uploaded"})
+			return
+		}
+		files, rev, code, err := replaceFromZip(cfg, v, work, tmpPath, base)
+		if err != nil {
+			c.JSON(code, errorBody(c, err))
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"status": "folder replaced"})
-	})
-
-	r.GET("/download", func(c *gin.Context) {
-		storeLock.RLock()
-		defer storeLock.RUnlock()
-
-		c.Header("Content-Disposition", `attachment; filename="folder.zip"`)
-		c.Header("Content-Type", "application/zip")
-		c.Header("Cache-Control", "no-store")
+		setAuditStats(c, files, size)
+		setRevision(c, rev)
+		c.JSON(http.StatusOK, gin.H{"status": "folder replaced", "revision": rev})
+	}
+}
 
-		zipWriter := zip.NewWriter(c.Writer)
-		defer zipWriter.Close()
+// maxFormField — предел для текстовых полей multipart (список удалений и т.п.)
+const maxFormField = 32 << 20
 
-		err := filepath.Walk(cfg.StoragePath, func(path string, info os.FileInfo, err error) error {
+// receiveMultipart читает multipart‑тело потоком, без буфера в памяти и без
+// промежуточных файлов во временном каталоге ОС: часть fileField пишется сразу
+// в dst, остальные поля возвращаются строками. size = -1, если файла не было.
+func receiveMultipart(c *gin.Context, fileField, dst string) (fields map[string]string, size int64, err error) {
+	mr, err := c.Request.MultipartReader()
+	if err != nil {
+		return nil, -1, err
+	}
+	fields, size = map[string]string{}, -1
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return fields, size, nil
+		}
+		if err != nil {
+			return nil, -1, err
+		}
+		switch {
+		case part.FormName() == fileField && size < 0:
+			out, err := os.Create(dst)
 			if err != nil {
-				return err
+				return nil, -1, err
 			}
-
-			relPath, _ := filepath.Rel(cfg.StoragePath, path)
-			if info.IsDir() {
-				if relPath == "." {
-					return nil
-				}
-				relPath += "/"
+			size, err = io.Copy(out, part)
+			if cerr := out.Close(); err == nil {
+				err = cerr
 			}
-
-			header, err := zip.FileInfoHeader(info)
 			if err != nil {
-				return err
-			}
-			header.Name = relPath
-			if !info.IsDir() {
-				header.Method = zip.Deflate
+				return nil, -1, err
 			}
-
-			writer, err := zipWriter.CreateHeader(header)
+		case part.FileName() == "":
+			data, err := io.ReadAll(io.LimitReader(part, maxFormField+1))
 			if err != nil {
-				return err
+				return nil, -1, err
 			}
-
-			if !info.IsDir() {
-				f, err := os.Open(path)
-				if err != nil {
-					return err
-				}
-				_, copyErr := io.Copy(writer, f)
-				closeErr := f.Close()
-				if copyErr != nil {
-					return copyErr
-				}
-				if closeErr != nil {
-					return closeErr
-				}
+			if len(data) > maxFormField {
+				return nil, -1, fmt.Errorf("form field %q is too large", part.FormName())
 			}
-			return nil
-		})
-
-		if err != nil {
-			// Уже начали стримить, меняем только статус в логах
-			log.Printf("download error: %v", err)
+			fields[part.FormName()] = string(data)
 		}
-	})
+		// Посторонние файловые части пропускаем, NextPart дочитает их сам
+		part.Close()
+	}
+}
 
-	srv := &http.Server{
-		Addr:    ":" + cfg.Port,
-		Handler: r,
+// multipartErrorStatus: превышение MAX_UPLOAD_MB — 413, остальное — кривой запрос
+func multipartErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
 	}
+	return http.StatusBadRequest
+}
 
-	go func() {
-		log.Printf("listening on :%s, storage=%s, tokens=%s", cfg.Port, cfg.StoragePath, cfg.TokenFile)
-		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Fatalf("listen: %v", err)
-		}
-	}()
+// replaceFromZip распаковывает архив во временный каталог work и подменяет им
+// содержимое vault, если тот всё ещё на ревизии base. Возвращает новую ревизию,
+// а при ошибке и HTTP‑статус: 400 — архив битый, 409 — ревизия устарела.
+func replaceFromZip(cfg Config, v *vault, work, zipPath string, base int64) (files int, rev int64, code int, err error) {
+	staged := filepath.Join(work, "tree")
+	files, err = safeUnzip(zipPath, staged)
+	if err != nil {
+		return 0, 0, http.StatusBadRequest, err
+	}
+	if err := os.MkdirAll(staged, 0755); err != nil {
+		return 0, 0, http.StatusInternalServerError, err
+	}
+	// Манифест нового дерева — чтение всей загрузки, поэтому до блокировки
+	after, err := buildManifest(staged)
+	if err != nil {
+		return 0, 0, http.StatusInternalServerError, err
+	}
+	defer pruneHashCache(staged, nil) // после подмены там уже ничего нет
 
-	<-ctx.Done()
-	log.Println("shutting down...")
-	shutCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	if err := srv.Shutdown(shutCtx); err != nil {
-		log.Printf("server shutdown error: %v", err)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if err := v.checkRevision(base); err != nil {
+		return 0, 0, http.StatusConflict, err
+	}
+	// Прежнее состояние сохраняем в снапшот, без этого не продолжаем
+	if _, err := takeSnapshot(cfg, v.root, "upload"); err != nil {
+		return 0, 0, http.StatusInternalServerError, fmt.Errorf("snapshot failed: %w", err)
+	}
+	if err := preserveChunks(v.root, func(string) bool { return true }, staged); err != nil {
+		return 0, 0, http.StatusInternalServerError, fmt.Errorf("snapshot failed: %w", err)
+	}
+	paths, complete := treeChanges(v.root, after)
+	if err := swapTree(v.root, staged, filepath.Join(work, "old")); err != nil {
+		return 0, 0, http.StatusInternalServerError, err
+	}
+	moveHashCache(staged, v.root)
+	rev = v.commitRevision("upload", paths, complete)
+	return files, rev, http.StatusOK, nil
+}
+
+func manifestHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v := currentVault(c)
+		v.mu.RLock()
+		defer v.mu.RUnlock()
+
+		m, err := buildManifest(v.root)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Header("Cache-Control", "no-store")
+		setRevision(c, v.revision())
+		c.JSON(http.StatusOK, m)
 	}
-	log.Println("bye")
 }
 
 func loadConfig() Config {
+	storage := getEnv("STORAGE_PATH", "/data")
 	return Config{
-		StoragePath:        getEnv("STORAGE_PATH", "/data"),
-		TokenFile:          getEnv("TOKENS_PATH", "/run/secrets/tokens.txt"),
-		Port:               getEnv("PORT", "1244"),
-		MaxMultipartMemory: getEnvBytes("MAX_MULTIPART_MB", 8) * 1024 * 1024,
-		MaxUploadBytes:     getEnvBytes("MAX_UPLOAD_MB", 0) * 1024 * 1024, // 0 = без лимита
+		StoragePath:          storage,
+		TokenFile:            getEnv("TOKENS_PATH", "/run/secrets/tokens.txt"),
+		Port:                 getEnv("PORT", "1244"),
+		MaxMultipartMemory:   getEnvBytes("MAX_MULTIPART_MB", 8) * 1024 * 1024,
+		MaxUploadBytes:       getEnvBytes("MAX_UPLOAD_MB", 0) * 1024 * 1024, // 0 = без лимита
+		SnapshotKeep:         int(getEnvInt("SNAPSHOT_KEEP", 10)),
+		SnapshotMaxAge:       getEnvDuration("SNAPSHOT_MAX_AGE", 0), // например 720h
+		SnapshotInterval:     getEnvDuration("SNAPSHOT_INTERVAL", 10*time.Minute),
+		VaultsPath:           getEnv("VAULTS_PATH", filepath.Join(storage, internalDir, "vaults")),
+		TokenPepper:          os.Getenv("TOKEN_PEPPER"),
+		TokenFallback:        getEnvBool("TOKEN_FALLBACK", false),
+		AuditLog:             getEnv("AUDIT_LOG", filepath.Join(storage, internalDir, "audit.log")),
+		AuditMaxBytes:        getEnvBytes("AUDIT_MAX_BYTES", 10<<20),
+		MetricsPublic:        getEnvBool("METRICS_PUBLIC", false),
+		TrustedProxies:       getEnvList("TRUSTED_PROXIES"), // например 10.0.0.0/8,172.16.0.0/12
+		RateLimitRPS:         getEnvFloat("RATE_LIMIT_RPS", 50),
+		RateLimitBurst:       int(getEnvInt("RATE_LIMIT_BURST", 200)),
+		GlobalRateLimitRPS:   getEnvFloat("RATE_LIMIT_GLOBAL_RPS", 500),
+		GlobalRateLimitBurst: int(getEnvInt("RATE_LIMIT_GLOBAL_BURST", 1000)),
+		AuthMaxFailures:      int(getEnvInt("AUTH_MAX_FAILURES", 5)),
+		AuthFailWindow:       getEnvDuration("AUTH_FAIL_WINDOW", 10*time.Minute),
+		AuthBanBase:          getEnvDuration("AUTH_BAN", time.Minute),
+		AuthBanMax:           getEnvDuration("AUTH_BAN_MAX", 24*time.Hour),
+		TLSCert:              os.Getenv("TLS_CERT"),
+		TLSKey:               os.Getenv("TLS_KEY"),
+		TLSClientCA:          os.Getenv("TLS_CLIENT_CA"),
+		UploadSessionTTL:     getEnvDuration("UPLOAD_SESSION_TTL", 24*time.Hour),
+		ArchiveCache:         getEnvBool("ARCHIVE_CACHE", false),
+		RequireIfMatch:       getEnvBool("REQUIRE_IF_MATCH", true), // false — для клиентов без ревизий
 	}
 }
 
@@ -227,149 +395,189 @@ func getEnvBytes(key string, defMB int64) int64 {
 	return defMB
 }
 
-func parseInt64(s string) (int64, error) {
-	var x int64
-	_, err := fmt.Sscan(s, &x)
-	return x, err
+func getEnvInt(key string, def int64) int64 {
+	if v := os.Getenv(key); v != "" {
+		if x, err := parseInt64(v); err == nil {
+			return x
+		}
+	}
+	return def
 }
 
-func authMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		auth := c.GetHeader("Authorization")
-		if auth == "" || !checkToken(auth) {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
-			return
+func getEnvBool(key string, def bool) bool {
+	if v := os.Getenv(key); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
 		}
-		c.Next()
 	}
+	return def
 }
 
-func loadTokens(path string) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		log.Printf("no tokens loaded from %s: %v", path, err)
-		return
-	}
-	newMap := make(map[string]struct{})
-	for _, line := range strings.Split(string(data), "\n") {
-		line = strings.TrimSpace(line)
-		if line != "" {
-			newMap[line] = struct{}{}
+func getEnvFloat(key string, def float64) float64 {
+	if v := os.Getenv(key); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
 		}
 	}
-	tokensLock.Lock()
-	tokens = newMap
-	tokensLock.Unlock()
-	log.Printf("tokens loaded: %d", len(newMap))
+	return def
 }
-
-func watchTokens(ctx context.Context, path string, every time.Duration) {
-	if every <= 0 {
-		every = 5 * time.Second
+func getEnvList(key string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
 	}
-	var lastMod time.Time
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-time.After(every):
-			fi, err := os.Stat(path)
-			if err != nil {
-				continue
-			}
-			if fi.ModTime().After(lastMod) {
-				lastMod = fi.ModTime()
-				loadTokens(path)
-			}
+	return list
+}
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
 		}
 	}
+	return def
 }
 
-func checkToken(token string) bool {
-	tokensLock.RLock()
-	defer tokensLock.RUnlock()
-	_, ok := tokens[token]
-	return ok
+func parseInt64(s string) (int64, error) {
+	var x int64
+	_, err := fmt.Sscan(s, &x)
+	return x, err
 }
 
-func safeUnzip(src, dest string) error {
+var errZipSlip = errors.New("zip slip detected")
+
+// safeUnzip распаковывает архив в dest и возвращает число файлов
+func safeUnzip(src, dest string) (files int, err error) {
+	defer func() {
+		if errors.Is(err, errZipSlip) {
+			metricZipSlip.inc()
+		} else if err != nil {
+			metricExtractErrors.inc()
+		}
+	}()
 	r, err := zip.OpenReader(src)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer r.Close()
 
 	cleanDest := filepath.Clean(dest)
 
 	for _, f := range r.File {
+		// Служебный каталог из архива не принимаем
+		if isInternalPath(strings.TrimLeft(f.Name, "/")) {
+			continue
+		}
 		fpath := filepath.Join(cleanDest, f.Name)
 
 		// Защита от zip slip
 		rel, err := filepath.Rel(cleanDest, fpath)
 		if err != nil {
-			return err
+			return files, err
 		}
 		if rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
-			return fmt.Errorf("zip slip detected: entry %q escapes %q", f.Name, dest)
+			return files, fmt.Errorf("%w: entry %q escapes %q", errZipSlip, f.Name, dest)
 		}
 
 		if f.FileInfo().IsDir() {
 			if err := os.MkdirAll(fpath, f.Mode()); err != nil {
-				return err
+				return files, err
 			}
 			continue
 		}
 
 		if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
-			return err
+			return files, err
 		}
 
 		outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
 		if err != nil {
-			return err
+			return files, err
 		}
 		rc, err := f.Open()
 		if err != nil {
 			_ = outFile.Close()
-			return err
+			return files, err
 		}
 
 		_, err = io.Copy(outFile, rc)
 		cerr1 := rc.Close()
 		cerr2 := outFile.Close()
 		if err != nil {
-			return err
+			return files, err
 		}
 		if cerr1 != nil {
-			return cerr1
+			return files, cerr1
 		}
 		if cerr2 != nil {
-			return cerr2
+			return files, cerr2
 		}
+		files++
 	}
-	return nil
+	return files, nil
 }
-func safeCleanDir(path string) error {
-	abs, err := filepath.Abs(path)
+
+// swapTree подменяет содержимое root содержимым staged. Текущие файлы переезжают
+// в trash, новые — на их место; всё это rename внутри одной ФС, так что подмена
+// быстрая и делается под блокировкой vault целиком: читатели видят либо старое дерево,
+// либо новое. Если какой‑то шаг не удался, всё возвращается как было.
+// Служебный каталог не трогается. trash вызывающий удаляет сам.
+func swapTree(root, staged, trash string) (err error) {
+	abs, err := filepath.Abs(root)
 	if err != nil {
 		return err
 	}
 	if abs == "/" || abs == "." {
-		return fmt.Errorf("refusing to clean unsafe path: %s", abs)
+		return fmt.Errorf("refusing to replace unsafe path: %s", abs)
 	}
-	// гарантируем, что каталог есть
-	if err := os.MkdirAll(abs, 0755); err != nil {
+	if err := os.MkdirAll(trash, 0755); err != nil {
 		return err
 	}
-	// удаляем только содержимое
-	entries, err := os.ReadDir(abs)
+
+	var old, placed []string
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, name := range placed {
+			if rerr := os.Rename(filepath.Join(abs, name), filepath.Join(staged, name)); rerr != nil {
+				log.Printf("swap rollback: %v", rerr)
+			}
+		}
+		for _, name := range old {
+			if rerr := os.Rename(filepath.Join(trash, name), filepath.Join(abs, name)); rerr != nil {
+				log.Printf("swap rollback: %v", rerr)
+			}
+		}
+	}()
+
+	current, err := os.ReadDir(abs)
 	if err != nil {
 		return err
 	}
-	for _, e := range entries {
-		if err := os.RemoveAll(filepath.Join(abs, e.Name())); err != nil {
+	for _, e := range current {
+		if e.Name() == internalDir {
+			continue
+		}
+		if err := os.Rename(filepath.Join(abs, e.Name()), filepath.Join(trash, e.Name())); err != nil {
+			return err
+		}
+		old = append(old, e.Name())
+	}
+
+	incoming, err := os.ReadDir(staged)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, e := range incoming {
+		if e.Name() == internalDir {
+			continue
+		}
+		if err := os.Rename(filepath.Join(staged, e.Name()), filepath.Join(abs, e.Name())); err != nil {
 			return err
 		}
+		placed = append(placed, e.Name())
 	}
 	return nil
 }
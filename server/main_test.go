@@ -0,0 +1,75 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeZip собирает архив с записями под указанными именами
+func writeZip(t *testing.T, path string, names ...string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for _, name := range names {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("data of " + name))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSafeUnzip(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		want    []string // что появилось в dest; nil — ожидаем zip slip
+	}{
+		{"plain", []string{"a.md", "dir/b.md"}, []string{"a.md", "dir/b.md"}},
+		{"absolute path stays inside", []string{"/etc/passwd"}, []string{"etc/passwd"}},
+		{"internal dir skipped", []string{internalDir + "/revision", "/" + internalDir + "/x", "a.md"}, []string{"a.md"}},
+		{"parent", []string{"a.md", "../evil"}, nil},
+		{"nested parent", []string{"dir/../../evil"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			zipPath, dest := filepath.Join(dir, "in.zip"), filepath.Join(dir, "out")
+			writeZip(t, zipPath, tt.entries...)
+
+			n, err := safeUnzip(zipPath, dest)
+			if tt.want == nil {
+				if !errors.Is(err, errZipSlip) {
+					t.Fatalf("err = %v, want zip slip", err)
+				}
+				if _, err := os.Stat(filepath.Join(dir, "evil")); err == nil {
+					t.Fatal("file written outside dest")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(tt.want) {
+				t.Errorf("files = %d, want %d", n, len(tt.want))
+			}
+			for _, rel := range tt.want {
+				if _, err := os.Stat(filepath.Join(dest, filepath.FromSlash(rel))); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
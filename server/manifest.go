@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileEntry — описание одного файла хранилища
+type FileEntry struct {
+	Path    string      `json:"path"` // относительный путь, всегда с прямыми слэшами
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"mtime"`
+	Mode    os.FileMode `json:"mode"`
+	SHA256  string      `json:"sha256"`
+}
+
+type Manifest struct {
+	Files []FileEntry `json:"files"`
+}
+
+type hashCacheEntry struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// Кэш хэшей: пересчитываем SHA-256 только если у файла поменялись размер или mtime.
+// Без него каждый запрос манифеста перечитывал бы весь vault (а это гигабайты).
+var (
+	hashCache     = make(map[string]hashCacheEntry)
+	hashCacheLock sync.Mutex
+)
+
+// buildManifest обходит root и собирает манифест всех обычных файлов.
+// Вызывающий должен держать блокировку vault (хотя бы на чтение).
+func buildManifest(root string) (Manifest, error) {
+	root = filepath.Clean(root)
+	files := []FileEntry{}
+	seen := make(map[string]struct{})
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root && errors.Is(err, fs.ErrNotExist) {
+				return filepath.SkipAll // vault ещё ни разу не записывали
+			}
+			return err
+		}
+		if d.IsDir() && path == filepath.Join(root, internalDir) {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		sum, err := cachedFileHash(path, info)
+		if err != nil {
+			return err
+		}
+		seen[path] = struct{}{}
+		files = append(files, FileEntry{
+			Path:    filepath.ToSlash(rel),
+			Size:    info.Size(),
+			ModTime: info.ModTime().UTC(),
+			Mode:    info.Mode().Perm(),
+			SHA256:  sum,
+		})
+		return nil
+	})
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	pruneHashCache(root, seen)
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return Manifest{Files: files}, nil
+}
+
+func cachedFileHash(path string, info os.FileInfo) (string, error) {
+	hashCacheLock.Lock()
+	e, ok := hashCache[path]
+	hashCacheLock.Unlock()
+	if ok && e.size == info.Size() && e.modTime.Equal(info.ModTime()) {
+		return e.sum, nil
+	}
+
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return "", err
+	}
+	hashCacheLock.Lock()
+	hashCache[path] = hashCacheEntry{size: info.Size(), modTime: info.ModTime(), sum: sum}
+	hashCacheLock.Unlock()
+	return sum, nil
+}
+
+// pruneHashCache выкидывает из кэша файлы под root, которых больше нет
+func pruneHashCache(root string, seen map[string]struct{}) {
+	prefix := root + string(os.PathSeparator)
+	internal := filepath.Join(root, internalDir) + string(os.PathSeparator) // там другие vault'ы
+	hashCacheLock.Lock()
+	defer hashCacheLock.Unlock()
+	for path := range hashCache {
+		if !strings.HasPrefix(path, prefix) || strings.HasPrefix(path, internal) {
+			continue
+		}
+		if _, ok := seen[path]; !ok {
+			delete(hashCache, path)
+		}
+	}
+}
+
+// moveHashCache переносит хэши файлов из-под from под to: после переименования
+// дерева файлы те же, пересчитывать их незачем
+func moveHashCache(from, to string) {
+	prefix := filepath.Clean(from) + string(os.PathSeparator)
+	hashCacheLock.Lock()
+	defer hashCacheLock.Unlock()
+	for path, e := range hashCache {
+		if rest, ok := strings.CutPrefix(path, prefix); ok {
+			delete(hashCache, path)
+			hashCache[filepath.Join(to, rest)] = e
+		}
+	}
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Метрики в текстовом формате Prometheus. Своя маленькая реализация вместо
+// client_golang: нужно десяток счётчиков, тащить ради них зависимость не стоит.
+
+// metricVec — метрика с набором меток: counter, gauge или histogram
+type metricVec struct {
+	name, help, kind string
+	labels           []string
+	buckets          []float64 // границы для histogram
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64  // counter/gauge
+	counts      []uint64 // histogram: число наблюдений по корзинам (не накопленное)
+	sum         float64
+	count       uint64
+}
+
+var allMetrics []*metricVec
+
+func newMetric(kind, name, help string, buckets []float64, labels ...string) *metricVec {
+	m := &metricVec{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: make(map[string]*series)}
+	allMetrics = append(allMetrics, m)
+	return m
+}
+
+func newCounter(name, help string, labels ...string) *metricVec {
+	return newMetric("counter", name, help, nil, labels...)
+}
+
+func newGauge(name, help string, labels ...string) *metricVec {
+	return newMetric("gauge", name, help, nil, labels...)
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metricVec {
+	return newMetric("histogram", name, help, buckets, labels...)
+}
+
+// get возвращает ряд для значений меток. Вызывается под m.mu.
+func (m *metricVec) get(lv []string) *series {
+	if len(lv) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s: want %d label values, got %d", m.name, len(m.labels), len(lv)))
+	}
+	key := strings.Join(lv, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), lv...)}
+		if m.kind == "histogram" {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metricVec) inc(lv ...string) { m.add(1, lv...) }
+
+func (m *metricVec) add(v float64, lv ...string) {
+	m.mu.Lock()
+	m.get(lv).value += v
+	m.mu.Unlock()
+}
+
+func (m *metricVec) set(v float64, lv ...string) {
+	m.mu.Lock()
+	m.get(lv).value = v
+	m.mu.Unlock()
+}
+
+func (m *metricVec) observe(v float64, lv ...string) {
+	m.mu.Lock()
+	s := m.get(lv)
+	for i, b := range m.buckets {
+		if v <= b {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+	m.mu.Unlock()
+}
+
+// reset убирает все ряды (для gauge, которые пересчитываются целиком)
+func (m *metricVec) reset() {
+	m.mu.Lock()
+	m.series = make(map[string]*series)
+	m.mu.Unlock()
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, s.labelValues, ""), formatFloat(s.value))
+			continue
+		}
+		var cum uint64
+		for i, b := range m.buckets {
+			cum += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labelValues, formatFloat(b)), cum)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labelValues, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labels, s.labelValues, ""), s.count)
+	}
+}
+
+func formatLabels(names, values []string, le string) string {
+	var parts []string
+	for i, n := range names {
+		parts = append(parts, n+`="`+escapeLabel(values[i])+`"`)
+	}
+	if le != "" {
+		parts = append(parts, `le="`+le+`"`)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+	sizeBuckets     = []float64{1 << 10, 16 << 10, 256 << 10, 1 << 20, 16 << 20, 128 << 20, 1 << 30, 4 << 30}
+
+	metricRequests = newCounter("syncerch_http_requests_total",
+		"HTTP requests by route, method and status code.", "route", "method", "code")
+	metricRequestDuration = newHistogram("syncerch_http_request_duration_seconds",
+		"HTTP request duration by route.", durationBuckets, "route")
+	metricOperations = newCounter("syncerch_operations_total",
+		"Vault operations (upload, download, delta, restore) by outcome.", "action", "outcome")
+	metricTransferBytes = newCounter("syncerch_transfer_bytes_total",
+		"Bytes received (upload, delta) or sent (download) by successful operations.", "action")
+	metricTransferSize = newHistogram("syncerch_transfer_size_bytes",
+		"Size of successful transfers.", sizeBuckets, "action")
+	metricTransferFiles = newCounter("syncerch_transfer_files_total",
+		"Files received or sent by successful operations.", "action")
+	metricExtractErrors = newCounter("syncerch_extract_errors_total",
+		"Uploaded archives that could not be extracted.")
+	metricZipSlip = newCounter("syncerch_zip_slip_rejections_total",
+		"Uploaded archives rejected for entries escaping the target directory.")
+	metricAuthFailures = newCounter("syncerch_auth_failures_total",
+		"Rejected requests by reason.", "reason")
+	metricRateLimited = newCounter("syncerch_rate_limited_total",
+		"Requests rejected with 429: per-IP limit, global limit or banned address.", "reason")
+	metricBans = newCounter("syncerch_auth_bans_total",
+		"Addresses banned after repeated authentication failures.")
+	metricBannedIPs = newGauge("syncerch_banned_ips",
+		"Addresses currently banned.")
+	metricTLSReloads = newCounter("syncerch_tls_reloads_total",
+		"Certificate reloads after the files changed, by result.", "result")
+	metricTLSCertExpiry = newGauge("syncerch_tls_cert_expiry_timestamp_seconds",
+		"Expiry time of the served certificate (Unix seconds).")
+	metricTokenReloads = newCounter("syncerch_token_reloads_total",
+		"Token file loads by result.", "result")
+	metricTokens = newGauge("syncerch_tokens",
+		"Tokens currently loaded.")
+	metricStorageBytes = newGauge("syncerch_storage_bytes",
+		"Size of files in a vault (excluding snapshots and internal data).", "vault")
+	metricStorageFiles = newGauge("syncerch_storage_files",
+		"Number of files in a vault.", "vault")
+	metricEventStreams = newGauge("syncerch_event_streams",
+		"Open /events streams.")
+)
+
+// metricsMiddleware считает запросы и их длительность. Маршрут берётся шаблоном
+// (/vaults/:vault/upload), чтобы число рядов не зависело от путей файлов.
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		metricRequests.inc(route, c.Request.Method, strconv.Itoa(c.Writer.Status()))
+		metricRequestDuration.observe(time.Since(start).Seconds(), route)
+	}
+}
+
+// observeOperation учитывает завершённую операцию с vault (вызывается из auditAction)
+func observeOperation(ev AuditEvent) {
+	metricOperations.inc(ev.Action, ev.Outcome)
+	if ev.Outcome != "ok" {
+		return
+	}
+	metricTransferBytes.add(float64(ev.Bytes), ev.Action)
+	metricTransferSize.observe(float64(ev.Bytes), ev.Action)
+	metricTransferFiles.add(float64(ev.Files), ev.Action)
+}
+
+// metricsHandler пересчитывает объём vault'ов и отдаёт все метрики
+func metricsHandler(cfg Config, lim *limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		updateStorageMetrics(cfg)
+		metricBannedIPs.set(float64(lim.bannedCount()))
+		c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		c.Status(http.StatusOK)
+		for _, m := range allMetrics {
+			m.write(c.Writer)
+		}
+	}
+}
+
+// updateStorageMetrics обходит vault'ы без блокировок: цифры нужны примерные,
+// а держать блокировку на время обхода большого дерева дорого
+func updateStorageMetrics(cfg Config) {
+	roots := map[string]string{defaultVault: cfg.StoragePath}
+	if entries, err := os.ReadDir(cfg.VaultsPath); err == nil {
+		for _, e := range entries {
+			if e.IsDir() && e.Name() != defaultVault && vaultNameRe.MatchString(e.Name()) {
+				roots[e.Name()] = filepath.Join(cfg.VaultsPath, e.Name())
+			}
+		}
+	}
+	metricStorageBytes.reset()
+	metricStorageFiles.reset()
+	for name, root := range roots {
+		root = filepath.Clean(root)
+		var files int
+		var size int64
+		_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil // файл могли удалить во время обхода
+			}
+			if d.IsDir() && d.Name() == internalDir && filepath.Dir(path) == root {
+				return filepath.SkipDir
+			}
+			if d.Type().IsRegular() {
+				if info, err := d.Info(); err == nil {
+					files++
+					size += info.Size()
+				}
+			}
+			return nil
+		})
+		metricStorageBytes.set(float64(size), name)
+		metricStorageFiles.set(float64(files), name)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Защита от перебора токенов: ограничение частоты запросов (на IP и общее)
+// и временный бан IP после серии неудачных попыток авторизации. Каждый
+// следующий бан вдвое длиннее предыдущего, но не длиннее AuthBanMax.
+// IP берётся из c.ClientIP(), поэтому X-Forwarded-For учитывается только
+// от прокси из TRUSTED_PROXIES — иначе обойти бан было бы слишком просто.
+
+// tokenBucket — классическое ведро токенов: rate в секунду, не больше burst
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) allow(now time.Time, rate float64, burst int) bool {
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// ipState — всё, что лимитер помнит про один адрес
+type ipState struct {
+	bucket      tokenBucket
+	failures    int // неудачных авторизаций подряд
+	lastFailure time.Time
+	strikes     int // сколько раз уже банили, от этого зависит длина бана
+	bannedUntil time.Time
+	lastSeen    time.Time
+}
+
+type limiter struct {
+	cfg Config
+
+	mu     sync.Mutex
+	ips    map[string]*ipState
+	global tokenBucket
+}
+
+func newLimiter(cfg Config) *limiter {
+	return &limiter{cfg: cfg, ips: make(map[string]*ipState)}
+}
+
+// state возвращает запись для ip. Вызывается под l.mu.
+func (l *limiter) state(ip string, now time.Time) *ipState {
+	s, ok := l.ips[ip]
+	if !ok {
+		s = &ipState{}
+		l.ips[ip] = s
+	}
+	s.lastSeen = now
+	return s
+}
+
+// middleware отсекает забаненные адреса и превышение частоты запросов.
+// Ставится перед authMiddleware.
+func (l *limiter) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ip := c.ClientIP()
+		now := time.Now()
+
+		l.mu.Lock()
+		s := l.state(ip, now)
+		var retry time.Duration
+		var reason string
+		switch {
+		case now.Before(s.bannedUntil):
+			retry, reason = s.bannedUntil.Sub(now), "banned"
+		case l.cfg.RateLimitRPS > 0 && !s.bucket.allow(now, l.cfg.RateLimitRPS, l.cfg.RateLimitBurst):
+			retry, reason = time.Second, "ip"
+		case l.cfg.GlobalRateLimitRPS > 0 && !l.global.allow(now, l.cfg.GlobalRateLimitRPS, l.cfg.GlobalRateLimitBurst):
+			retry, reason = time.Second, "global"
+		}
+		l.mu.Unlock()
+
+		if reason == "" {
+			c.Next()
+			return
+		}
+		metricRateLimited.inc(reason)
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+		if reason == "banned" {
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "too many failed attempts, try again later"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded"})
+	}
+}
+
+// authFailed учитывает неудачную авторизацию и при необходимости банит адрес.
+// Возвращает длину бана, если он начался сейчас.
+func (l *limiter) authFailed(ip string) time.Duration {
+	if l.cfg.AuthMaxFailures <= 0 {
+		return 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.state(ip, now)
+	if now.Sub(s.lastFailure) > l.cfg.AuthFailWindow {
+		s.failures = 0
+	}
+	s.failures++
+	s.lastFailure = now
+	if s.failures < l.cfg.AuthMaxFailures {
+		return 0
+	}
+
+	ban := l.cfg.AuthBanBase << min(s.strikes, 20)
+	if ban <= 0 || ban > l.cfg.AuthBanMax {
+		ban = l.cfg.AuthBanMax
+	}
+	s.strikes++
+	s.failures = 0
+	s.bannedUntil = now.Add(ban)
+	metricBans.inc()
+	log.Printf("auth: %s banned for %s after %d failed attempts (ban #%d)", ip, ban, l.cfg.AuthMaxFailures, s.strikes)
+	return ban
+}
+
+// authSucceeded сбрасывает счётчик неудач адреса
+func (l *limiter) authSucceeded(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s, ok := l.ips[ip]; ok {
+		s.failures = 0
+	}
+}
+
+// bannedCount — число адресов под баном сейчас
+func (l *limiter) bannedCount() int {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, s := range l.ips {
+		if now.Before(s.bannedUntil) {
+			n++
+		}
+	}
+	return n
+}
+
+// cleanup периодически забывает адреса, которые давно не появлялись и не забанены.
+// Адреса, которых уже банили, помнятся сутки: за это время следующий бан будет длиннее.
+func (l *limiter) cleanup(ctx context.Context, every time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(every):
+			now := time.Now()
+			l.mu.Lock()
+			for ip, s := range l.ips {
+				idle := now.Sub(s.lastSeen)
+				if now.After(s.bannedUntil) && (idle > 24*time.Hour || s.strikes == 0 && idle > l.cfg.AuthFailWindow) {
+					delete(l.ips, ip)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+func (l *limiter) String() string {
+	return fmt.Sprintf("rate %.4g/s (burst %d) per IP, %.4g/s (burst %d) global; ban after %d failures for %s..%s",
+		l.cfg.RateLimitRPS, l.cfg.RateLimitBurst, l.cfg.GlobalRateLimitRPS, l.cfg.GlobalRateLimitBurst,
+		l.cfg.AuthMaxFailures, l.cfg.AuthBanBase, l.cfg.AuthBanMax)
+}
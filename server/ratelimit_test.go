@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		at    []time.Duration // моменты запросов от start
+		want  []bool
+	}{
+		{"burst then empty", 1, 3, []time.Duration{0, 0, 0, 0}, []bool{true, true, true, false}},
+		{"refills at rate", 2, 1, []time.Duration{0, 0, 400 * time.Millisecond, 500 * time.Millisecond}, []bool{true, false, false, true}},
+		{"refill capped at burst", 10, 2, []time.Duration{0, 0, time.Hour, time.Hour, time.Hour}, []bool{true, true, true, true, false}},
+		{"zero burst", 1, 0, []time.Duration{0, time.Second}, []bool{false, false}},
+	}
+	for _, tt := range tests {
+		var b tokenBucket
+		for i, d := range tt.at {
+			if got := b.allow(start.Add(d), tt.rate, tt.burst); got != tt.want[i] {
+				t.Errorf("%s: request %d at %v: allow = %v, want %v", tt.name, i, d, got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestAuthFailedBans(t *testing.T) {
+	cfg := Config{AuthMaxFailures: 3, AuthFailWindow: time.Minute, AuthBanBase: time.Minute, AuthBanMax: 5 * time.Minute}
+	l := newLimiter(cfg)
+
+	// Бан каждый раз вдвое длиннее, но не длиннее AuthBanMax
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		for i := 1; i < cfg.AuthMaxFailures; i++ {
+			if ban := l.authFailed("1.2.3.4"); ban != 0 {
+				t.Fatalf("banned after %d failures", i)
+			}
+		}
+		if ban := l.authFailed("1.2.3.4"); ban != want {
+			t.Fatalf("ban = %v, want %v", ban, want)
+		}
+	}
+	if n := l.bannedCount(); n != 1 {
+		t.Errorf("bannedCount = %d, want 1", n)
+	}
+
+	// Удачный вход сбрасывает счётчик неудач
+	l.authFailed("5.6.7.8")
+	l.authFailed("5.6.7.8")
+	l.authSucceeded("5.6.7.8")
+	if ban := l.authFailed("5.6.7.8"); ban != 0 {
+		t.Errorf("banned despite a successful login in between")
+	}
+
+	// AuthMaxFailures = 0 — баны выключены
+	off := newLimiter(Config{AuthBanBase: time.Minute, AuthBanMax: time.Minute})
+	for range 10 {
+		if ban := off.authFailed("1.2.3.4"); ban != 0 {
+			t.Fatal("banned with AuthMaxFailures = 0")
+		}
+	}
+}
+
+func TestLimiterMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name string
+		cfg  Config
+		ban  bool
+		ips  []string // адрес каждого запроса по порядку
+		want []int
+	}{
+		{
+			name: "per ip burst",
+			cfg:  Config{RateLimitRPS: 0.001, RateLimitBurst: 2},
+			ips:  []string{"10.0.0.1", "10.0.0.1", "10.0.0.1", "10.0.0.2"},
+			want: []int{200, 200, 429, 200},
+		},
+		{
+			name: "global burst",
+			cfg:  Config{GlobalRateLimitRPS: 0.001, GlobalRateLimitBurst: 2},
+			ips:  []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+			want: []int{200, 200, 429},
+		},
+		{
+			name: "disabled",
+			cfg:  Config{},
+			ips:  []string{"10.0.0.1", "10.0.0.1", "10.0.0.1"},
+			want: []int{200, 200, 200},
+		},
+		{
+			name: "banned ip",
+			cfg:  Config{AuthMaxFailures: 1, AuthFailWindow: time.Minute, AuthBanBase: time.Hour, AuthBanMax: time.Hour},
+			ban:  true,
+			ips:  []string{"10.0.0.1", "10.0.0.2"},
+			want: []int{429, 200},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLimiter(tt.cfg)
+			if tt.ban {
+				l.authFailed("10.0.0.1")
+			}
+			r := gin.New()
+			r.Use(l.middleware())
+			r.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+			for i, ip := range tt.ips {
+				req := httptest.NewRequest("GET", "/", nil)
+				req.RemoteAddr = ip + ":1234"
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+				if w.Code != tt.want[i] {
+					t.Fatalf("request %d from %s: %d, want %d", i, ip, w.Code, tt.want[i])
+				}
+				if w.Code != http.StatusTooManyRequests {
+					continue
+				}
+				want := "1"
+				if tt.ban {
+					want = "3600"
+				}
+				if got := w.Header().Get("Retry-After"); got != want {
+					t.Errorf("Retry-After = %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Оптимистичная блокировка: запись в vault (upload, delta, коммиты загрузок
+// и кусков) должна прийти с If-Match: <ревизия>, на которой клиент основывал
+// изменения — её он получил в X-Syncerch-Revision от /manifest или /download.
+// Если с тех пор vault успел кто‑то изменить, ответ 409 с текущей ревизией
+// вместо молчаливой перезаписи чужих правок. If-Match: * — писать поверх
+// любой ревизии (осознанная перезапись). Без заголовка — 428, если только
+// REQUIRE_IF_MATCH=false не разрешает это старым клиентам.
+const revisionHeader = "X-Syncerch-Revision"
+
+// anyRevision — проверка ревизии не нужна
+const anyRevision = -1
+
+// staleRevisionError — клиент основывался на устаревшей ревизии
+type staleRevisionError struct {
+	base, current int64
+}
+
+func (e *staleRevisionError) Error() string {
+	return fmt.Sprintf("vault changed: client is based on revision %d, current is %d", e.base, e.current)
+}
+
+// parseRevision разбирает значение If-Match: 12, "12", W/"12", ETag архива
+// "12-<digest>" или *. ok = false — заголовок не разобрать.
+func parseRevision(h string) (rev int64, ok bool) {
+	h = strings.TrimSpace(h)
+	if h == "*" {
+		return anyRevision, true
+	}
+	h = strings.Trim(strings.TrimPrefix(h, "W/"), `"`)
+	h, _, _ = strings.Cut(h, "-")
+	rev, err := strconv.ParseInt(h, 10, 64)
+	return rev, err == nil && rev >= 0
+}
+
+// baseRevision читает If-Match запроса на запись. Если заголовка нет или он
+// кривой, сам отвечает 428/400 и возвращает ok = false.
+func baseRevision(c *gin.Context, cfg Config) (rev int64, ok bool) {
+	h := c.GetHeader("If-Match")
+	if h == "" {
+		if !cfg.RequireIfMatch {
+			return anyRevision, true
+		}
+		c.Header(revisionHeader, strconv.FormatInt(currentVault(c).revision(), 10))
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match with the vault revision is required"})
+		return 0, false
+	}
+	if rev, ok = parseRevision(h); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid If-Match"})
+		return 0, false
+	}
+	return rev, true
+}
+
+// revision — текущая ревизия vault
+func (v *vault) revision() int64 {
+	v.events.mu.Lock()
+	defer v.events.mu.Unlock()
+	return v.events.rev
+}
+
+// checkRevision сверяет ревизию, на которой основан запрос, с текущей.
+// Чтобы проверка что‑то гарантировала, вызывающий держит v.mu на запись;
+// без блокировки это лишь ранний отказ, пока тело запроса ещё не принято.
+func (v *vault) checkRevision(base int64) error {
+	if base == anyRevision {
+		return nil
+	}
+	if cur := v.revision(); cur != base {
+		return &staleRevisionError{base: base, current: cur}
+	}
+	return nil
+}
+
+// errorBody — тело ответа об ошибке; при конфликте ревизий в нём ещё и текущая ревизия
+func errorBody(c *gin.Context, err error) gin.H {
+	var stale *staleRevisionError
+	if errors.As(err, &stale) {
+		c.Header(revisionHeader, strconv.FormatInt(stale.current, 10))
+		return gin.H{"error": err.Error(), "revision": stale.current}
+	}
+	return gin.H{"error": err.Error()}
+}
+
+// rejectStale отвечает 409, если запрос основан на устаревшей ревизии
+func rejectStale(c *gin.Context, v *vault, base int64) bool {
+	if err := v.checkRevision(base); err != nil {
+		c.JSON(http.StatusConflict, errorBody(c, err))
+		return true
+	}
+	return false
+}
+
+// setRevision сообщает клиенту ревизию, которую он теперь видит
+func setRevision(c *gin.Context, rev int64) {
+	c.Header(revisionHeader, strconv.FormatInt(rev, 10))
+}
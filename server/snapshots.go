@@ -0,0 +1,454 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Снапшоты лежат в <storage>/.syncerch/snapshots/<id>/: snapshot.json с
+// описанием и files.json — рецепты всех файлов дерева (куски по SHA‑256, см.
+// chunks.go). Сами куски живут либо в файлах текущего дерева, либо в хранилище
+// блоков: перед каждой записью куски уходящих версий, на которые ссылаются
+// снапшоты, переносятся в блоки (preserveChunks). Поэтому снапшот неизменённого
+// дерева — это один JSON, а слегка изменённый большой файл добавляет в историю
+// только свои изменённые куски. Снапшоты старого формата (дерево жёстких
+// ссылок в tree/) по‑прежнему восстанавливаются.
+const snapshotsDir = "snapshots"
+
+const (
+	snapshotMetaFile  = "snapshot.json"
+	snapshotFilesFile = "files.json"
+)
+
+var snapshotIDRe = regexp.MustCompile(`^[0-9]{8}-[0-9]{6}\.[0-9]{3}$`)
+
+type SnapshotInfo struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Reason  string    `json:"reason"` // что затёрло это состояние: upload, delta, restore
+	Files   int       `json:"files"`
+	Bytes   int64     `json:"bytes"`
+}
+
+func snapshotsRoot(root string) string {
+	return filepath.Join(root, internalDir, snapshotsDir)
+}
+
+// snapshotFile — файл в снапшоте: его атрибуты и куски по порядку
+type snapshotFile struct {
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"mtime"`
+	Mode    os.FileMode `json:"mode"`
+	SHA256  string      `json:"sha256"`
+	Chunks  []chunkRef  `json:"chunks"`
+}
+
+// takeSnapshot сохраняет рецепты текущего дерева root перед изменением и чистит
+// старые снапшоты вместе с блоками, на которые больше никто не ссылается.
+// Пустое дерево не сохраняется. Вызывающий должен держать блокировку vault на запись.
+func takeSnapshot(cfg Config, root, reason string) (SnapshotInfo, error) {
+	if cfg.SnapshotKeep <= 0 {
+		return SnapshotInfo{}, nil
+	}
+	ix := vaultChunkIndex(root)
+	if err := ix.refresh(root); err != nil {
+		return SnapshotInfo{}, err
+	}
+	info := SnapshotInfo{Created: time.Now().UTC(), Reason: reason}
+	files := make(map[string]snapshotFile)
+	for rel, r := range ix.recipes() {
+		fi, err := os.Lstat(filepath.Join(root, filepath.FromSlash(rel)))
+		if err != nil {
+			return SnapshotInfo{}, err
+		}
+		sum, err := cachedFileHash(filepath.Join(root, filepath.FromSlash(rel)), fi)
+		if err != nil {
+			return SnapshotInfo{}, err
+		}
+		files[rel] = snapshotFile{Size: r.Size, ModTime: r.ModTime.UTC(), Mode: fi.Mode().Perm(), SHA256: sum, Chunks: r.Chunks}
+		info.Files++
+		info.Bytes += r.Size
+	}
+	if info.Files == 0 {
+		return SnapshotInfo{}, nil
+	}
+
+	base := snapshotsRoot(root)
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return SnapshotInfo{}, err
+	}
+	tmp, err := os.MkdirTemp(base, ".tmp-*")
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	defer os.RemoveAll(tmp) // после успешного rename его уже нет
+
+	// id = время создания; при совпадении сдвигаемся на миллисекунду
+	for t := info.Created; ; t = t.Add(time.Millisecond) {
+		info.ID = t.Format("20060102-150405.000")
+		if _, err := os.Stat(filepath.Join(base, info.ID)); errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+	}
+	data, err := json.Marshal(files)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	if err := os.WriteFile(filepath.Join(tmp, snapshotFilesFile), data, 0644); err != nil {
+		return SnapshotInfo{}, err
+	}
+	meta, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	if err := os.WriteFile(filepath.Join(tmp, snapshotMetaFile), meta, 0644); err != nil {
+		return SnapshotInfo{}, err
+	}
+	if err := os.Rename(tmp, filepath.Join(base, info.ID)); err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	pruneSnapshots(cfg, root)
+	pruneBlobs(cfg, root)
+	return info, nil
+}
+
+// readSnapshotFiles читает рецепты файлов снапшота. Для снапшота старого
+// формата (дерево жёстких ссылок) возвращает fs.ErrNotExist.
+func readSnapshotFiles(root, id string) (map[string]snapshotFile, error) {
+	data, err := os.ReadFile(filepath.Join(snapshotsRoot(root), id, snapshotFilesFile))
+	if err != nil {
+		return nil, err
+	}
+	var files map[string]snapshotFile
+	if err := json.Unmarshal(data, &files); err != nil {
+		return nil, fmt.Errorf("snapshot %s: %w", id, err)
+	}
+	return files, nil
+}
+
+// Счётчики ссылок пересчитываются, только когда меняется набор снапшотов:
+// сами снапшоты после создания не меняются
+var (
+	blockRefsCache   = make(map[string]blockRefsEntry)
+	blockRefsCacheMu sync.Mutex
+)
+
+type blockRefsEntry struct {
+	ids  string
+	refs map[string]int
+}
+
+// blockRefs считает, сколько раз снапшоты ссылаются на каждый кусок.
+// Кусок с нулём ссылок хранить незачем. Результат не менять.
+func blockRefs(root string) (map[string]int, error) {
+	list, err := listSnapshots(root)
+	if err != nil {
+		return nil, err
+	}
+	var ids strings.Builder
+	for _, s := range list {
+		ids.WriteString(s.ID + " ")
+	}
+	blockRefsCacheMu.Lock()
+	cached, ok := blockRefsCache[root]
+	blockRefsCacheMu.Unlock()
+	if ok && cached.ids == ids.String() {
+		return cached.refs, nil
+	}
+
+	refs := make(map[string]int)
+	for _, s := range list {
+		files, err := readSnapshotFiles(root, s.ID)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // старый формат, блоки ему не нужны
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			for _, ch := range f.Chunks {
+				refs[ch.Hash]++
+			}
+		}
+	}
+	blockRefsCacheMu.Lock()
+	blockRefsCache[root] = blockRefsEntry{ids: ids.String(), refs: refs}
+	blockRefsCacheMu.Unlock()
+	return refs, nil
+}
+
+// snapshotDue — нужен ли снапшот перед дельтой. Дельты (в том числе от
+// режима слежения) идут часто и мелкие: снапшот перед каждой вытеснил бы
+// из SnapshotKeep всю полезную историю за минуты, а обход дерева под
+// блокировкой vault тормозил бы запись. Поэтому перед дельтой снапшот
+// делается не чаще раза в SnapshotInterval; upload и restore — всегда.
+func snapshotDue(cfg Config, root string) bool {
+	if cfg.SnapshotInterval <= 0 {
+		return true
+	}
+	entries, err := os.ReadDir(snapshotsRoot(root))
+	if err != nil {
+		return true
+	}
+	// id — время создания, так что самый свежий — наибольшее имя
+	latest := ""
+	for _, e := range entries {
+		if e.IsDir() && snapshotIDRe.MatchString(e.Name()) && e.Name() > latest {
+			latest = e.Name()
+		}
+	}
+	created, err := time.Parse("20060102-150405.000", latest)
+	return err != nil || time.Since(created) >= cfg.SnapshotInterval
+}
+
+// listSnapshots возвращает снапшоты от новых к старым
+func listSnapshots(root string) ([]SnapshotInfo, error) {
+	entries, err := os.ReadDir(snapshotsRoot(root))
+	if errors.Is(err, fs.ErrNotExist) {
+		return []SnapshotInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	list := []SnapshotInfo{}
+	for _, e := range entries {
+		if !e.IsDir() || !snapshotIDRe.MatchString(e.Name()) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(snapshotsRoot(root), e.Name(), snapshotMetaFile))
+		if err != nil {
+			log.Printf("snapshot %s: %v", e.Name(), err)
+			continue
+		}
+		var info SnapshotInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			log.Printf("snapshot %s: %v", e.Name(), err)
+			continue
+		}
+		info.ID = e.Name()
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID > list[j].ID })
+	return list, nil
+}
+
+// pruneSnapshots оставляет не больше SnapshotKeep снапшотов и удаляет те,
+// что старше SnapshotMaxAge (если задан). Самый свежий не удаляется никогда.
+func pruneSnapshots(cfg Config, root string) {
+	list, err := listSnapshots(root)
+	if err != nil {
+		log.Printf("prune snapshots: %v", err)
+		return
+	}
+	for i, s := range list {
+		if i == 0 {
+			continue
+		}
+		expired := cfg.SnapshotMaxAge > 0 && time.Since(s.Created) > cfg.SnapshotMaxAge
+		if i < cfg.SnapshotKeep && !expired {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(snapshotsRoot(root), s.ID)); err != nil {
+			log.Printf("prune snapshot %s: %v", s.ID, err)
+		}
+	}
+}
+
+// restoreSnapshot заменяет содержимое root деревом снапшота id и возвращает
+// изменённые пути (см. treeChanges).
+// Текущее состояние перед этим само уходит в снапшот, так что restore тоже можно откатить.
+func restoreSnapshot(cfg Config, root, id string) (paths []string, complete bool, err error) {
+	if !snapshotIDRe.MatchString(id) {
+		return nil, false, fmt.Errorf("invalid snapshot id %q", id)
+	}
+	dir := filepath.Join(snapshotsRoot(root), id)
+	if _, err := os.Stat(filepath.Join(dir, snapshotMetaFile)); err != nil {
+		return nil, false, err
+	}
+
+	// Сначала собираем дерево снапшота в рабочем каталоге: takeSnapshot ниже
+	// может удалить по ретенции как раз тот снапшот, который восстанавливаем
+	work, err := makeWorkDir(root, "restore-*")
+	if err != nil {
+		return nil, false, err
+	}
+	defer os.RemoveAll(work)
+	staged := filepath.Join(work, "tree")
+	after, err := stageSnapshot(root, id, staged)
+	defer pruneHashCache(staged, nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if _, err := takeSnapshot(cfg, root, "restore"); err != nil {
+		return nil, false, err
+	}
+	if err := preserveChunks(root, func(string) bool { return true }, staged); err != nil {
+		return nil, false, err
+	}
+	paths, complete = treeChanges(root, after)
+	if err := swapTree(root, staged, filepath.Join(work, "old")); err != nil {
+		return nil, false, err
+	}
+	moveHashCache(staged, root)
+	return paths, complete, nil
+}
+
+// stageSnapshot собирает дерево снапшота id в staged: из кусков или, для
+// старого формата, жёсткими ссылками. Возвращает манифест собранного дерева.
+func stageSnapshot(root, id, staged string) (Manifest, error) {
+	files, err := readSnapshotFiles(root, id)
+	if errors.Is(err, fs.ErrNotExist) {
+		if _, _, err := linkTree(filepath.Join(snapshotsRoot(root), id, "tree"), staged); err != nil {
+			return Manifest{}, err
+		}
+		return buildManifest(staged)
+	}
+	if err != nil {
+		return Manifest{}, err
+	}
+	list := make([]chunkedFile, 0, len(files))
+	m := Manifest{Files: make([]FileEntry, 0, len(files))}
+	for rel, f := range files {
+		list = append(list, chunkedFile{Path: rel, Size: f.Size, Mode: f.Mode, SHA256: f.SHA256, Chunks: f.Chunks})
+		m.Files = append(m.Files, FileEntry{Path: rel, Size: f.Size, ModTime: f.ModTime, Mode: f.Mode, SHA256: f.SHA256})
+	}
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Path < m.Files[j].Path })
+	if err := os.MkdirAll(staged, 0755); err != nil {
+		return Manifest{}, err
+	}
+	if _, _, _, err := assembleFiles(root, vaultChunkIndex(root), staged, list); err != nil {
+		var missing missingChunksError
+		if errors.As(err, &missing) {
+			return Manifest{}, fmt.Errorf("snapshot %s is damaged: %w", id, err)
+		}
+		return Manifest{}, err
+	}
+	for rel, f := range files {
+		_ = os.Chtimes(filepath.Join(staged, filepath.FromSlash(rel)), f.ModTime, f.ModTime)
+	}
+	return m, nil
+}
+
+// linkTree воссоздаёт дерево src в dst жёсткими ссылками (или копиями, если ссылки
+// недоступны). Служебный каталог не переносится. Возвращает число файлов и их объём.
+func linkTree(src, dst string) (files int, bytes int64, err error) {
+	src = filepath.Clean(src)
+	err = filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && rel == internalDir {
+			return filepath.SkipDir
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if err := os.Link(path, target); err != nil {
+			if err := copyFile(path, target, info.Mode().Perm()); err != nil {
+				return err
+			}
+		}
+		files++
+		bytes += info.Size()
+		return nil
+	})
+	return files, bytes, err
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func snapshotsHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v := currentVault(c)
+		v.mu.RLock()
+		defer v.mu.RUnlock()
+
+		list, err := listSnapshots(v.root)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"snapshots": list})
+	}
+}
+
+func restoreHandler(cfg Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v := currentVault(c)
+		id := c.Param("id")
+		// restore — осознанный откат, If-Match для него необязателен
+		base := int64(anyRevision)
+		if h := c.GetHeader("If-Match"); h != "" {
+			var ok bool
+			if base, ok = parseRevision(h); !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid If-Match"})
+				return
+			}
+		}
+
+		v.mu.Lock()
+		defer v.mu.Unlock()
+
+		if rejectStale(c, v, base) {
+			return
+		}
+		paths, complete, err := restoreSnapshot(cfg, v.root, id)
+		if err != nil {
+			switch {
+			case !snapshotIDRe.MatchString(id):
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			case errors.Is(err, fs.ErrNotExist):
+				c.JSON(http.StatusNotFound, gin.H{"error": "snapshot not found"})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+		rev := v.commitRevision("restore", paths, complete)
+		setRevision(c, rev)
+		c.JSON(http.StatusOK, gin.H{"status": "snapshot restored", "id": id, "revision": rev})
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// blobsOnDisk — блоки хранилища и их общий объём
+func blobsOnDisk(t *testing.T, root string) (hashes []string, size int64) {
+	t.Helper()
+	err := filepath.WalkDir(blocksRoot(root), func(path string, d os.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return filepath.SkipAll
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, d.Name())
+		size += info.Size()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hashes, size
+}
+
+// delta применяет дельту: files — новые версии, deleted — удаления
+func delta(t *testing.T, cfg Config, v *vault, files map[string][]byte, deleted ...string) {
+	t.Helper()
+	work := t.TempDir()
+	for rel, data := range files {
+		p := filepath.Join(work, "staged", filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, _, _, err := applyDeltaZip(cfg, v, work, "", deleted, anyRevision); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func latestSnapshot(t *testing.T, root string) string {
+	t.Helper()
+	list, err := listSnapshots(root)
+	if err != nil || len(list) == 0 {
+		t.Fatalf("no snapshots: %v", err)
+	}
+	return list[0].ID
+}
+
+func TestSnapshotBlockStore(t *testing.T) {
+	t.Setenv("STORAGE_PATH", t.TempDir())
+	t.Setenv("SNAPSHOT_INTERVAL", "0")
+	t.Setenv("SNAPSHOT_KEEP", "2")
+	cfg := loadConfig()
+	cfg.UploadSessionTTL = time.Nanosecond // блоки без ссылок удаляются сразу
+	v, err := getVault(cfg, "blockstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(v.root, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	v1 := cdcStream("big", 2<<20)
+	v2 := bytes.Clone(v1)
+	copy(v2[1<<20:], "a small edit in the middle")
+	delta(t, cfg, v, map[string][]byte{"big.bin": v1, "a.md": []byte("note")})
+
+	// Правка в середине большого файла: в историю уходят только её куски
+	delta(t, cfg, v, map[string][]byte{"big.bin": v2})
+	first := latestSnapshot(t, v.root)
+	blobs, size := blobsOnDisk(t, v.root)
+	if len(blobs) == 0 || size > 2*cdcMax {
+		t.Fatalf("%d blocks, %d bytes kept for a small edit", len(blobs), size)
+	}
+
+	// Удалённый файл целиком уходит в блоки
+	delta(t, cfg, v, nil, "a.md")
+	if blobs, _ := blobsOnDisk(t, v.root); len(blobs) == 0 {
+		t.Fatal("no blocks")
+	}
+
+	// Каждый кусок истории — в дереве или в блоках: повторная загрузка ничего не передаст
+	ix := vaultChunkIndex(v.root)
+	if err := ix.refresh(v.root); err != nil {
+		t.Fatal(err)
+	}
+	refs, err := blockRefs(v.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for h := range refs {
+		if _, ok := ix.locate(h); ok {
+			continue
+		}
+		if _, err := os.Stat(blobPath(v.root, h)); err != nil {
+			t.Fatalf("chunk %s is lost", h)
+		}
+	}
+
+	// Восстановление собирает старые версии из дерева и блоков
+	v.mu.Lock()
+	_, _, err = restoreSnapshot(cfg, v.root, first)
+	v.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := buildManifest(v.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Files) != 2 {
+		t.Fatalf("restored %d files, want 2", len(m.Files))
+	}
+	for rel, want := range map[string][]byte{"big.bin": v1, "a.md": []byte("note")} {
+		if got, err := os.ReadFile(filepath.Join(v.root, rel)); err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("%s: restored content does not match the snapshot (%v)", rel, err)
+		}
+	}
+
+	// Ретенция: блоки снапшотов, которых больше нет, удаляются
+	delta(t, cfg, v, map[string][]byte{"c.md": []byte("c")})
+	delta(t, cfg, v, map[string][]byte{"d.md": []byte("d")})
+	if list, _ := listSnapshots(v.root); len(list) != 2 {
+		t.Fatalf("%d snapshots, want 2", len(list))
+	}
+	refs, err = blockRefs(v.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs, _ = blobsOnDisk(t, v.root)
+	for _, h := range blobs {
+		if refs[h] == 0 {
+			t.Errorf("block %s outlived its snapshots", h)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Встроенный TLS: сертификат и ключ из TLS_CERT/TLS_KEY перечитываются при
+// изменении файлов (certbot и т.п. обновляют их на месте), перезапуск не нужен.
+// Если задан TLS_CLIENT_CA, клиенты обязаны предъявить сертификат, подписанный
+// этим CA (mTLS) — это дополнительный барьер перед проверкой токена.
+
+type certReloader struct {
+	certFile, keyFile, caFile string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	mods     [3]time.Time // mtime cert, key, CA на момент последней загрузки
+}
+
+func newCertReloader(cfg Config) (*certReloader, error) {
+	if cfg.TLSCert == "" || cfg.TLSKey == "" {
+		return nil, errors.New("TLS_CERT and TLS_KEY must be set together")
+	}
+	r := &certReloader{certFile: cfg.TLSCert, keyFile: cfg.TLSKey, caFile: cfg.TLSClientCA}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load читает сертификат, ключ и CA. При ошибке прежние значения остаются в силе.
+func (r *certReloader) load() error {
+	mods, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", r.caFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert, r.clientCA, r.mods = &cert, pool, mods
+	r.mu.Unlock()
+
+	if cert.Leaf != nil {
+		metricTLSCertExpiry.set(float64(cert.Leaf.NotAfter.Unix()))
+		log.Printf("tls: loaded %s (%s), expires %s", r.certFile, cert.Leaf.Subject, cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (r *certReloader) modTimes() ([3]time.Time, error) {
+	var mods [3]time.Time
+	for i, p := range []string{r.certFile, r.keyFile, r.caFile} {
+		if p == "" {
+			continue
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			return mods, err
+		}
+		mods[i] = fi.ModTime()
+	}
+	return mods, nil
+}
+
+// watch перечитывает файлы, когда у любого из них меняется mtime
+func (r *certReloader) watch(ctx context.Context, every time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(every):
+			mods, err := r.modTimes()
+			if err != nil {
+				continue // файл могут как раз подменять
+			}
+			r.mu.RLock()
+			changed := mods != r.mods
+			r.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := r.load(); err != nil {
+				// cert и key обновляются не одновременно: пара может не сойтись до следующего тика
+				metricTLSReloads.inc("error")
+				log.Printf("tls reload: %v, keeping previous certificate", err)
+				continue
+			}
+			metricTLSReloads.inc("ok")
+		}
+	}
+}
+
+// tlsConfig собирает конфигурацию, которая берёт сертификат и CA из reloader
+// на каждом рукопожатии
+func (r *certReloader) tlsConfig() *tls.Config {
+	c := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.cert, nil
+		},
+	}
+	if r.caFile == "" {
+		return c
+	}
+	// Цепочку проверяем сами против текущего CA: стандартная проверка
+	// (RequireAndVerifyClientCert) видела бы только пул на момент запуска
+	c.ClientAuth = tls.RequireAnyClientCert
+	c.ClientCAs = r.clientCA // только подсказка клиенту, какой сертификат предъявить
+	c.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs = append(certs, cert)
+		}
+		if len(certs) == 0 {
+			return errors.New("client certificate required")
+		}
+		r.mu.RLock()
+		roots := r.clientCA
+		r.mu.RUnlock()
+		opts := x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(opts)
+		return err
+	}
+	return c
+}
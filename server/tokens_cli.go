@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const tokenUsage = `usage:
+  server token add [-name NAME] [-perms rw] [-vault a,b]   создать токен (печатается один раз), a — админ
+  server token list                                        показать токены (без секретов)
+  server token revoke NAME|ID                              отозвать по имени или отпечатку
+  server token migrate                                     захэшировать токены, хранящиеся открытым текстом
+`
+
+// runCommand выполняет подкоманду вместо запуска сервера и возвращает код выхода.
+// Работающий сервер подхватывает изменения файла токенов сам (watchTokens).
+func runCommand(cfg Config, args []string, stdout, stderr io.Writer) int {
+	if len(args) < 2 || args[0] != "token" {
+		fmt.Fprint(stderr, tokenUsage)
+		return 2
+	}
+	var err error
+	switch args[1] {
+	case "add":
+		err = tokenAdd(cfg.TokenFile, args[2:], stdout)
+	case "list":
+		err = tokenList(cfg.TokenFile, stdout)
+	case "revoke":
+		if len(args) != 3 {
+			fmt.Fprint(stderr, tokenUsage)
+			return 2
+		}
+		err = tokenRevoke(cfg.TokenFile, args[2], stdout)
+	case "migrate":
+		err = tokenMigrate(cfg.TokenFile, stdout)
+	default:
+		fmt.Fprint(stderr, tokenUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "error:", err)
+		return 1
+	}
+	return 0
+}
+
+func tokenAdd(path string, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("token add", flag.ContinueOnError)
+	name := flags.String("name", "", "имя устройства/владельца")
+	perms := flags.String("perms", "rw", "права: r, w, a (журнал аудита) в любом сочетании")
+	vault := flags.String("vault", "", "vault'ы через запятую (пусто — все)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if strings.ContainsAny(*name+*perms+*vault, " \t=") {
+		return errors.New("name, perms and vault must not contain spaces or '='")
+	}
+	// Токен без прав ничего не может, а с неизвестной буквой не загрузится
+	if err := checkPerms(*perms); err != nil {
+		return err
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	line := tokenHashPrefix + hex.EncodeToString(hashToken(token))
+	if *name != "" {
+		line += " name=" + *name
+	}
+	line += " perms=" + *perms
+	if *vault != "" {
+		line += " vault=" + *vault
+	}
+	// Проверяем строку тем же парсером, что и сервер
+	e, err := parseTokenLine(line)
+	if err != nil {
+		return err
+	}
+
+	lines, err := readTokenLines(path)
+	if err != nil {
+		return err
+	}
+	if err := writeTokenLines(path, append(lines, line)); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "token %s added (id %s); it will not be shown again:\n%s\n", *name, e.info.ID, token)
+	return nil
+}
+
+func tokenList(path string, stdout io.Writer) error {
+	lines, err := readTokenLines(path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%-12s  %-16s  %-5s  %-7s  %s\n", "ID", "NAME", "PERMS", "STORED", "VAULTS")
+	for n, line := range lines {
+		e, ok := parseListedToken(line)
+		if !ok {
+			if trimmed := strings.TrimSpace(line); trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+				fmt.Fprintf(stdout, "line %d: invalid entry\n", n+1)
+			}
+			continue
+		}
+		stored := "hashed"
+		if !strings.HasPrefix(line, tokenHashPrefix) {
+			stored = "PLAIN"
+		}
+		vaults := "*"
+		if e.info.Vaults != nil {
+			var names []string
+			for v := range e.info.Vaults {
+				names = append(names, v)
+			}
+			vaults = strings.Join(names, ",")
+		}
+		fmt.Fprintf(stdout, "%-12s  %-16s  %-5s  %-7s  %s\n", e.info.ID, e.info.Name, e.info.Perms, stored, vaults)
+	}
+	return nil
+}
+
+// tokenRevoke удаляет все записи с таким именем или отпечатком (или его началом, от 6 символов)
+func tokenRevoke(path, who string, stdout io.Writer) error {
+	lines, err := readTokenLines(path)
+	if err != nil {
+		return err
+	}
+	var kept []string
+	revoked := 0
+	for _, line := range lines {
+		if e, ok := parseListedToken(line); ok {
+			if e.info.Name == who || (len(who) >= 6 && strings.HasPrefix(e.info.ID, who)) {
+				revoked++
+				continue
+			}
+		}
+		kept = append(kept, line)
+	}
+	if revoked == 0 {
+		return fmt.Errorf("no token matches %q", who)
+	}
+	if err := writeTokenLines(path, kept); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "revoked %d token(s)\n", revoked)
+	return nil
+}
+
+// tokenMigrate заменяет открытые токены их хэшами, сохраняя права
+func tokenMigrate(path string, stdout io.Writer) error {
+	lines, err := readTokenLines(path)
+	if err != nil {
+		return err
+	}
+	migrated := 0
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], tokenHashPrefix) {
+			continue
+		}
+		if _, ok := parseListedToken(line); !ok {
+			continue // битые строки не трогаем, сервер их всё равно пропускает
+		}
+		fields[0] = tokenHashPrefix + hex.EncodeToString(hashToken(fields[0]))
+		lines[i] = strings.Join(fields, " ")
+		migrated++
+	}
+	if migrated == 0 {
+		fmt.Fprintln(stdout, "nothing to migrate")
+		return nil
+	}
+	if err := writeTokenLines(path, lines); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "migrated %d token(s)\n", migrated)
+	return nil
+}
+
+func parseListedToken(line string) (tokenEntry, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return tokenEntry{}, false
+	}
+	e, err := parseTokenLine(line)
+	return e, err == nil
+}
+
+func readTokenLines(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return nil, nil
+	}
+	return lines, nil
+}
+
+// writeTokenLines пишет файл токенов целиком через временный файл и rename,
+// чтобы сервер никогда не прочитал его наполовину записанным
+func writeTokenLines(path string, lines []string) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".tokens-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	data := strings.Join(lines, "\n")
+	if data != "" {
+		data += "\n"
+	}
+	if _, err := tmp.WriteString(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
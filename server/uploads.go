@@ -0,0 +1,506 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Докачиваемая загрузка: архив приходит кусками в сессию, которая хранится
+// в <vault>/.syncerch/uploads/<id>/ (session.json и сам архив data, куски
+// пишутся в него по смещению). Оборвалась связь — клиент спрашивает у сессии,
+// каких кусков нет, и шлёт только их. Коммит делает то же, что /upload
+// (kind=replace) или /delta (kind=delta), но с уже лежащим на диске архивом.
+const uploadsDir = "uploads"
+
+const (
+	uploadMetaFile = "session.json"
+	uploadDataFile = "data"
+
+	defaultChunkSize = 8 << 20
+	minChunkSize     = 64 << 10
+	maxChunkSize     = 64 << 20
+)
+
+var uploadIDRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// uploadsMu защищает session.json всех сессий: правки мелкие, общего замка хватает
+var uploadsMu sync.Mutex
+
+type UploadSession struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"` // replace или delta
+	Size      int64     `json:"size"`
+	ChunkSize int64     `json:"chunk_size"`
+	SHA256    string    `json:"sha256,omitempty"` // хэш всего архива, проверяется при коммите
+	TokenID   string    `json:"token_id"`         // сессию продолжает только тот же токен
+	Created   time.Time `json:"created"`
+	Updated   time.Time `json:"updated"`
+	Received  []bool    `json:"received"`
+	Base      int64     `json:"base"` // ревизия из If-Match при создании, -1 — любая
+	// committing выставляется на время коммита, куски в это время не принимаются
+	Committing bool `json:"-"`
+}
+
+func (s *UploadSession) chunks() int {
+	return len(s.Received)
+}
+
+// chunkLen — ожидаемая длина куска n: последний может быть короче
+func (s *UploadSession) chunkLen(n int) int64 {
+	return min(s.ChunkSize, s.Size-int64(n)*s.ChunkSize)
+}
+
+func (s *UploadSession) missing() []int {
+	missing := []int{}
+	for i, ok := range s.Received {
+		if !ok {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+func (s *UploadSession) status() gin.H {
+	missing := s.missing()
+	return gin.H{
+		"id":         s.ID,
+		"kind":       s.Kind,
+		"size":       s.Size,
+		"chunk_size": s.ChunkSize,
+		"chunks":     s.chunks(),
+		"received":   s.chunks() - len(missing),
+		"missing":    missing,
+	}
+}
+
+func uploadsRoot(root string) string {
+	return filepath.Join(root, internalDir, uploadsDir)
+}
+
+// activeSessions — сессии, которые сейчас коммитятся (по пути каталога)
+var activeSessions = map[string]bool{}
+
+// chunkWriters — сколько кусков сейчас пишется в data сессии (по пути
+// каталога). Пока запись не закончена, коммит отказывает: иначе он прочитал бы
+// архив с наполовину переписанным куском. Обе карты — под uploadsMu.
+var chunkWriters = map[string]int{}
+
+// releaseChunkWriter снимает отметку о записи куска. Вызывается под uploadsMu.
+func releaseChunkWriter(dir string) {
+	if chunkWriters[dir]--; chunkWriters[dir] <= 0 {
+		delete(chunkWriters, dir)
+	}
+}
+
+// loadUploadSession читает сессию. Вызывается под uploadsMu.
+func loadUploadSession(dir string) (*UploadSession, error) {
+	data, err := os.ReadFile(filepath.Join(dir, uploadMetaFile))
+	if err != nil {
+		return nil, err
+	}
+	var s UploadSession
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	s.Committing = activeSessions[dir]
+	return &s, nil
+}
+
+// saveUploadSession пишет session.json атомарно. Вызывается под uploadsMu.
+func saveUploadSession(dir string, s *UploadSession) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, uploadMetaFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, uploadMetaFile))
+}
+
+// sessionFromRequest находит сессию из :id и проверяет, что она принадлежит
+// этому токену. При ошибке ответ уже отправлен. Вызывается под uploadsMu.
+func sessionFromRequest(c *gin.Context) (string, *UploadSession, bool) {
+	id := c.Param("id")
+	if !uploadIDRe.MatchString(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload session not found"})
+		return "", nil, false
+	}
+	dir := filepath.Join(uploadsRoot(currentVault(c).root), id)
+	s, err := loadUploadSession(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload session not found"})
+		return "", nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return "", nil, false
+	}
+	if s.TokenID != currentToken(c).ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "upload session belongs to another token"})
+		return "", nil, false
+	}
+	return dir, s, true
+}
+
+// createUploadHandler заводит сессию: {"kind", "size", "sha256", "chunk_size"}
+func createUploadHandler(cfg Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v := currentVault(c)
+		var req struct {
+			Kind      string `json:"kind"`
+			Size      int64  `json:"size"`
+			SHA256    string `json:"sha256"`
+			ChunkSize int64  `json:"chunk_size"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if req.Kind == "" {
+			req.Kind = "replace"
+		}
+		if req.Kind != "replace" && req.Kind != "delta" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "kind must be replace or delta"})
+			return
+		}
+		if req.Size <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "size must be positive"})
+			return
+		}
+		if cfg.MaxUploadBytes > 0 && req.Size > cfg.MaxUploadBytes {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "upload exceeds MAX_UPLOAD_MB"})
+			return
+		}
+		req.SHA256 = strings.ToLower(req.SHA256)
+		if req.SHA256 != "" {
+			if raw, err := hex.DecodeString(req.SHA256); err != nil || len(raw) != sha256.Size {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "sha256 must be a hex digest"})
+				return
+			}
+		}
+		if req.ChunkSize == 0 {
+			req.ChunkSize = defaultChunkSize
+		}
+		req.ChunkSize = max(minChunkSize, min(req.ChunkSize, maxChunkSize))
+
+		// Устаревшую ревизию отклоняем сразу, а не после загрузки всего архива
+		base, ok := baseRevision(c, cfg)
+		if !ok || rejectStale(c, v, base) {
+			return
+		}
+
+		pruneUploadSessions(cfg, v.root)
+
+		var raw [16]byte
+		if _, err := rand.Read(raw[:]); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		now := time.Now().UTC()
+		s := &UploadSession{
+			ID:        hex.EncodeToString(raw[:]),
+			Kind:      req.Kind,
+			Size:      req.Size,
+			ChunkSize: req.ChunkSize,
+			SHA256:    req.SHA256,
+			TokenID:   currentToken(c).ID,
+			Created:   now,
+			Updated:   now,
+			Received:  make([]bool, (req.Size+req.ChunkSize-1)/req.ChunkSize),
+			Base:      base,
+		}
+		dir := filepath.Join(uploadsRoot(v.root), s.ID)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		f, err := os.Create(filepath.Join(dir, uploadDataFile))
+		if err == nil {
+			err = f.Close()
+		}
+		if err == nil {
+			uploadsMu.Lock()
+			err = saveUploadSession(dir, s)
+			uploadsMu.Unlock()
+		}
+		if err != nil {
+			_ = os.RemoveAll(dir)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, s.status())
+	}
+}
+
+// uploadStatusHandler показывает, какие куски сервер уже получил
+func uploadStatusHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uploadsMu.Lock()
+		defer uploadsMu.Unlock()
+		_, s, ok := sessionFromRequest(c)
+		if !ok {
+			return
+		}
+		c.JSON(http.StatusOK, s.status())
+	}
+}
+
+// uploadChunkHandler принимает кусок :n. Тело — ровно chunk_size байт (последний
+// кусок короче). Заголовок X-Chunk-SHA256, если есть, сверяется с телом.
+// Повторная отправка куска просто перезаписывает его.
+func uploadChunkHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		n, err := strconv.Atoi(c.Param("n"))
+		uploadsMu.Lock()
+		dir, s, ok := sessionFromRequest(c)
+		switch {
+		case !ok:
+		case s.Committing:
+			c.JSON(http.StatusConflict, gin.H{"error": "upload is being committed"})
+			ok = false
+		case err != nil || n < 0 || n >= s.chunks():
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("chunk must be 0..%d", s.chunks()-1)})
+			ok = false
+		case c.Request.ContentLength >= 0 && c.Request.ContentLength != s.chunkLen(n):
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("chunk %d must be %d bytes", n, s.chunkLen(n))})
+			ok = false
+		default:
+			// Отметку ставим до открытия файла, под тем же замком, под которым
+			// коммит проверяет её и помечает сессию — между ними не проскочить
+			chunkWriters[dir]++
+		}
+		uploadsMu.Unlock()
+		if !ok {
+			return
+		}
+		want := s.chunkLen(n)
+
+		f, err := os.OpenFile(filepath.Join(dir, uploadDataFile), os.O_WRONLY, 0)
+		if err != nil {
+			uploadsMu.Lock()
+			releaseChunkWriter(dir)
+			uploadsMu.Unlock()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		h := sha256.New()
+		w := io.NewOffsetWriter(f, int64(n)*s.ChunkSize)
+		written, err := io.Copy(io.MultiWriter(w, h), io.LimitReader(c.Request.Body, want+1))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		switch {
+		case err != nil:
+		case written != want:
+			err = fmt.Errorf("chunk %d must be %d bytes, got %d", n, want, written)
+		case c.GetHeader("X-Chunk-SHA256") != "" && !strings.EqualFold(c.GetHeader("X-Chunk-SHA256"), hex.EncodeToString(h.Sum(nil))):
+			err = fmt.Errorf("chunk %d checksum mismatch", n)
+		}
+
+		uploadsMu.Lock()
+		defer uploadsMu.Unlock()
+		releaseChunkWriter(dir)
+		// Пока писали, сессию могли удалить — перечитываем
+		s, lerr := loadUploadSession(dir)
+		if lerr != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "upload session not found"})
+			return
+		}
+		// Неудачная запись могла испортить ранее принятый кусок, так что он снова нужен
+		s.Received[n] = err == nil
+		s.Updated = time.Now().UTC()
+		if serr := saveUploadSession(dir, s); serr != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": serr.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"chunk": n, "received": s.chunks() - len(s.missing()), "chunks": s.chunks()})
+	}
+}
+
+// commitUploadHandler применяет собранный архив. Для kind=delta в теле
+// можно передать {"deleted": [...]}, как поле deleted у /delta.
+// После успеха или битого архива сессия удаляется; после внутренней ошибки
+// остаётся, чтобы коммит можно было повторить.
+func commitUploadHandler(cfg Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v := currentVault(c)
+		var req struct {
+			Deleted []string `json:"deleted"`
+		}
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		uploadsMu.Lock()
+		dir, s, ok := sessionFromRequest(c)
+		if ok && s.Committing {
+			c.JSON(http.StatusConflict, gin.H{"error": "upload is already being committed"})
+			ok = false
+		}
+		if ok && chunkWriters[dir] > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "chunks are still being written, retry the commit"})
+			ok = false
+		}
+		if ok {
+			activeSessions[dir] = true
+		}
+		uploadsMu.Unlock()
+		if !ok {
+			return
+		}
+		defer func() {
+			uploadsMu.Lock()
+			delete(activeSessions, dir)
+			uploadsMu.Unlock()
+		}()
+
+		if missing := s.missing(); len(missing) > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("%d chunks missing", len(missing)), "missing": missing})
+			return
+		}
+		if len(req.Deleted) > 0 && s.Kind != "delta" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "deleted is only allowed for kind=delta"})
+			return
+		}
+		// If-Match коммита главнее ревизии, с которой сессию создавали:
+		// после 409 клиент может разобраться и подтвердить ту же загрузку
+		base := s.Base
+		if c.GetHeader("If-Match") != "" {
+			var ok bool
+			if base, ok = baseRevision(c, cfg); !ok {
+				return
+			}
+		}
+		if rejectStale(c, v, base) {
+			return
+		}
+		data := filepath.Join(dir, uploadDataFile)
+		if s.SHA256 != "" {
+			sum, err := fileSHA256(data)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if sum != s.SHA256 {
+				// Какой кусок испорчен, неизвестно: начинать придётся заново
+				_ = os.RemoveAll(dir)
+				c.JSON(http.StatusBadRequest, gin.H{"error": "archive checksum mismatch, upload discarded"})
+				return
+			}
+		}
+
+		work, err := makeWorkDir(v.root, "commit-*")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer os.RemoveAll(work)
+
+		if s.Kind == "replace" {
+			files, rev, code, err := replaceFromZip(cfg, v, work, data, base)
+			if err != nil {
+				if code == http.StatusBadRequest {
+					_ = os.RemoveAll(dir)
+				}
+				c.JSON(code, errorBody(c, err))
+				return
+			}
+			_ = os.RemoveAll(dir)
+			setAuditStats(c, files, s.Size)
+			setRevision(c, rev)
+			c.JSON(http.StatusOK, gin.H{"status": "folder replaced", "revision": rev})
+			return
+		}
+
+		changed, removed, rev, code, err := applyDeltaZip(cfg, v, work, data, req.Deleted, base)
+		if err != nil {
+			if code == http.StatusBadRequest {
+				_ = os.RemoveAll(dir)
+			}
+			c.JSON(code, errorBody(c, err))
+			return
+		}
+		_ = os.RemoveAll(dir)
+		setAuditStats(c, changed+removed, s.Size)
+		setRevision(c, rev)
+		c.JSON(http.StatusOK, gin.H{"status": "delta applied", "changed": changed, "deleted": removed, "revision": rev})
+	}
+}
+
+// abortUploadHandler удаляет сессию вместе с принятыми кусками
+func abortUploadHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uploadsMu.Lock()
+		defer uploadsMu.Unlock()
+		dir, s, ok := sessionFromRequest(c)
+		if !ok {
+			return
+		}
+		if s.Committing {
+			c.JSON(http.StatusConflict, gin.H{"error": "upload is being committed"})
+			return
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "upload aborted"})
+	}
+}
+
+// pruneUploadSessions удаляет сессии, которые не трогали дольше UploadSessionTTL
+func pruneUploadSessions(cfg Config, root string) {
+	if cfg.UploadSessionTTL <= 0 {
+		return
+	}
+	base := uploadsRoot(root)
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		return
+	}
+	uploadsMu.Lock()
+	defer uploadsMu.Unlock()
+	for _, e := range entries {
+		dir := filepath.Join(base, e.Name())
+		if activeSessions[dir] || chunkWriters[dir] > 0 {
+			continue
+		}
+		updated := time.Time{}
+		if s, err := loadUploadSession(dir); err == nil {
+			updated = s.Updated
+		} else if info, err := e.Info(); err == nil {
+			updated = info.ModTime() // session.json ещё не записан или испорчен
+		}
+		if time.Since(updated) < cfg.UploadSessionTTL {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("prune upload %s: %v", e.Name(), err)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testServer — маршруты vault'ов за токеном с правами rw, storage во временном каталоге
+func testServer(t *testing.T) (*gin.Engine, Config) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	t.Setenv("STORAGE_PATH", t.TempDir())
+	cfg := loadConfig()
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("token", tokenInfo{Perms: "rw"})
+		c.Next()
+	})
+	registerVaultRoutes(r.Group("/vaults/:vault", vaultMiddleware(cfg)), cfg)
+	return r, cfg
+}
+
+func serve(r http.Handler, method, url, ifMatch string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, bytes.NewReader(body))
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func zipBytes(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(data))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Коммит, отклонённый с 409 или 500, можно повторить: сессия и архив остаются
+func TestCommitRetry(t *testing.T) {
+	r, cfg := testServer(t)
+	base := "/vaults/commit-retry"
+	data := zipBytes(t, map[string]string{"a.md": "hello"})
+	create, _ := json.Marshal(map[string]any{"kind": "replace", "size": len(data)})
+
+	if w := serve(r, "POST", base+"/uploads", "", create); w.Code != http.StatusPreconditionRequired {
+		t.Fatalf("create without If-Match: %d, want 428", w.Code)
+	}
+	if w := serve(r, "POST", base+"/uploads", "7", create); w.Code != http.StatusConflict {
+		t.Fatalf("create on a stale revision: %d, want 409", w.Code)
+	}
+	w := serve(r, "POST", base+"/uploads", "0", create)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	var st struct{ ID string }
+	if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	session := base + "/uploads/" + st.ID
+	if w := serve(r, "PUT", session+"/chunks/0", "", data); w.Code != http.StatusOK {
+		t.Fatalf("chunk: %d %s", w.Code, w.Body)
+	}
+
+	// Снапшот перед заменой не создать — коммит падает с 500
+	blocker := snapshotsRoot(filepath.Join(cfg.VaultsPath, "commit-retry"))
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(r, "POST", session+"/commit", "0", nil); w.Code != http.StatusInternalServerError {
+		t.Fatalf("commit without snapshots: %d %s, want 500", w.Code, w.Body)
+	}
+	if err := os.Remove(blocker); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(r, "POST", session+"/commit", "3", nil); w.Code != http.StatusConflict {
+		t.Fatalf("commit on a stale revision: %d %s, want 409", w.Code, w.Body)
+	}
+	if w := serve(r, "POST", session+"/commit", "abc", nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("commit with a bad If-Match: %d %s, want 400", w.Code, w.Body)
+	}
+
+	w = serve(r, "POST", session+"/commit", "0", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("retried commit: %d %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get(revisionHeader); got != "1" {
+		t.Errorf("revision = %q, want 1", got)
+	}
+	w = serve(r, "GET", base+"/files/a.md", "", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Fatalf("a.md: %d %q", w.Code, w.Body)
+	}
+	if w := serve(r, "GET", session, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("session after commit: %d, want 404", w.Code)
+	}
+	if w := serve(r, "POST", session+"/commit", "1", nil); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "error") {
+		t.Errorf("second commit: %d %s, want 404", w.Code, w.Body)
+	}
+}
+
+// Замена дерева целиком публикует в событии ровно изменённые пути
+func TestReplaceEventPaths(t *testing.T) {
+	t.Setenv("STORAGE_PATH", t.TempDir())
+	t.Setenv("SNAPSHOT_INTERVAL", "0")
+	cfg := loadConfig()
+	v, err := getVault(cfg, "replace-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTree(t, v.root, map[string]string{"same.md": "same", "edit.md": "old", "gone.md": "gone"})
+
+	replace := func(files map[string]string) []string {
+		t.Helper()
+		work, err := makeWorkDir(v.root, "upload-*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(work)
+		zipPath := filepath.Join(work, "upload.zip")
+		if err := os.WriteFile(zipPath, zipBytes(t, files), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := replaceFromZip(cfg, v, work, zipPath, anyRevision); err != nil {
+			t.Fatal(err)
+		}
+		ev := v.events.history[len(v.events.history)-1]
+		if ev.Truncated {
+			t.Fatalf("event without paths: %+v", ev)
+		}
+		return ev.Paths
+	}
+
+	// mtime из архива у same.md другой, но содержимое то же — это не изменение
+	got := replace(map[string]string{"same.md": "same", "edit.md": "new", "dir/add.md": "add"})
+	if want := []string{"dir/add.md", "edit.md", "gone.md"}; !slices.Equal(got, want) {
+		t.Errorf("upload paths = %v, want %v", got, want)
+	}
+	hashCacheLock.Lock()
+	_, cached := hashCache[filepath.Join(v.root, "dir", "add.md")]
+	hashCacheLock.Unlock()
+	if !cached {
+		t.Error("hashes of the uploaded tree are not carried over")
+	}
+
+	v.mu.Lock()
+	paths, complete, err := restoreSnapshot(cfg, v.root, latestSnapshot(t, v.root))
+	v.mu.Unlock()
+	if err != nil || !complete {
+		t.Fatalf("restore: %v, complete %v", err, complete)
+	}
+	if want := []string{"dir/add.md", "edit.md", "gone.md"}; !slices.Equal(paths, want) {
+		t.Errorf("restore paths = %v, want %v", paths, want)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// vault "default" — это сам StoragePath (так было до появления vault'ов),
+// остальные лежат в VaultsPath/<имя>, у каждого своя блокировка
+const defaultVault = "default"
+
+var vaultNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,63}$`)
+
+// vault — одна синхронизируемая папка
+type vault struct {
+	name string
+	root string
+	mu   sync.RWMutex // защищает операции чтения/записи каталога root
+
+	events eventHub // ревизия и подписчики /events, см. events.go
+
+	archiveMu sync.Mutex // не даёт двум запросам собирать архив этого vault одновременно
+}
+
+var (
+	vaults     = make(map[string]*vault)
+	vaultsLock sync.Mutex
+)
+
+var errBadVaultName = errors.New("invalid vault name")
+
+// getVault возвращает vault по имени. Каталог не создаётся: его заводит первая
+// запись (ensureVaultDir), а чтение несуществующего vault видит его пустым.
+func getVault(cfg Config, name string) (*vault, error) {
+	if name == "" {
+		name = defaultVault
+	}
+	if !vaultNameRe.MatchString(name) {
+		return nil, errBadVaultName
+	}
+
+	vaultsLock.Lock()
+	defer vaultsLock.Unlock()
+	if v, ok := vaults[name]; ok {
+		return v, nil
+	}
+	root := cfg.StoragePath
+	if name != defaultVault {
+		root = filepath.Join(cfg.VaultsPath, name)
+	}
+	v := &vault{name: name, root: root}
+	v.events.rev = loadRevision(root)
+	vaults[name] = v
+	return v, nil
+}
+
+// ensureVaultDir создаёт каталог vault перед запросом на запись
+func ensureVaultDir() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := os.MkdirAll(currentVault(c).root, 0755); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Next()
+	}
+}
+
+// vaultMiddleware находит vault из пути (/vaults/:vault/...) и кладёт его в контекст
+func vaultMiddleware(cfg Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("vault")
+		if name == "" {
+			name = defaultVault
+		}
+		if !currentToken(c).allowsVault(name) {
+			metricAuthFailures.inc("vault")
+			auditDenied(c, http.StatusForbidden, "token has no access to vault "+name)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "token has no access to this vault"})
+			return
+		}
+		v, err := getVault(cfg, name)
+		if errors.Is(err, errBadVaultName) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Set("vault", v)
+		c.Next()
+	}
+}
+
+func currentVault(c *gin.Context) *vault {
+	return c.MustGet("vault").(*vault)
+}
+
+// vaultsHandler перечисляет существующие vault'ы, доступные токену
+func vaultsHandler(cfg Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := currentToken(c)
+		names := []string{}
+		if token.allowsVault(defaultVault) {
+			names = append(names, defaultVault)
+		}
+		entries, err := os.ReadDir(cfg.VaultsPath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		var named []string
+		for _, e := range entries {
+			if e.IsDir() && e.Name() != defaultVault && vaultNameRe.MatchString(e.Name()) && token.allowsVault(e.Name()) {
+				named = append(named, e.Name())
+			}
+		}
+		sort.Strings(named)
+		c.JSON(http.StatusOK, gin.H{"vaults": append(names, named...)})
+	}
+}